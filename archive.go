@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"example/josh/goserver/metadata"
+)
+
+// archiveParams are the query parameters the archive handler understands.
+// Each is also described in openapi.json.
+var archiveParams = map[string]bool{
+	"format": true, "depth": true, "hidden": true, "gitignore": true,
+	"include": true, "exclude": true,
+}
+
+// archiveWriter adds entries to a tar or zip stream.
+type archiveWriter interface {
+	addDir(name string, fi fs.FileInfo) error
+	addFile(name string, fi fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// archiveHandler streams a tar or zip archive of the directory at the path
+// after /archive/. The tree is walked with the same options as a listing,
+// so ignored files and links leading out of the root are left out, and each
+// file is added as soon as the walk reaches it.
+func (s *server) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var unknown []string
+	for key := range r.URL.Query() {
+		if !archiveParams[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown query parameter %q", unknown[0]))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "tar"
+	case "tar", "zip":
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q: must be tar or zip", format))
+		return
+	}
+	opts, err := parseWalkOptions(r, s.gzipLevel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Only the contents are wanted, not what they would compress to.
+	opts.SkipGzip = true
+	s.applyWalkSettings(&opts)
+
+	name, err := resolvePath(s.root, strings.TrimPrefix(r.URL.Path, "/archive"))
+	if err != nil {
+		writeResolveError(w, r, err)
+		return
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		writeWalkError(w, r, name, err)
+		return
+	}
+	if !fi.IsDir() {
+		writeError(w, http.StatusBadRequest, "Not a directory")
+		return
+	}
+
+	// Entries are stored under the directory's own name, as tar -C would.
+	base := fi.Name()
+	if name == "." {
+		base = filepath.Base(s.root)
+	}
+	contentType := "application/x-tar"
+	if format == "zip" {
+		contentType = "application/zip"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": base + "." + format}))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var aw archiveWriter
+	if format == "zip" {
+		aw = newZipArchive(w, s.gzipLevel)
+	} else {
+		aw = tarArchive{tar.NewWriter(w)}
+	}
+	err = s.streamEntries(w, r, name, opts, func(e metadata.FileMetadata) error {
+		entryName := base
+		if e.Path != name {
+			entryName = path.Join(base, strings.TrimPrefix(e.Path, name+"/"))
+		}
+		return s.addToArchive(aw, e, entryName)
+	})
+	if err != nil {
+		// Closing would write the trailer and pass the archive off as
+		// complete; a dropped connection tells the client it isn't.
+		slog.WarnContext(r.Context(), "streaming walk ended early", "path", name, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	if err := aw.Close(); err != nil {
+		slog.WarnContext(r.Context(), "finishing archive", "path", name, "err", err)
+	}
+}
+
+// addToArchive writes one walked entry. Only directories and regular files
+// are stored; links that weren't followed, devices and pipes are skipped.
+// A file that can no longer be read is skipped too, but one that fails
+// part way through ends the archive, since its header has already gone out.
+func (s *server) addToArchive(aw archiveWriter, e metadata.FileMetadata, entryName string) error {
+	switch e.Type {
+	case "directory":
+		fi, err := fs.Stat(s.fsys, e.Path)
+		if err != nil {
+			return nil
+		}
+		return aw.addDir(entryName, fi)
+	case "file":
+	default:
+		return nil
+	}
+
+	f, err := s.fsys.Open(e.Path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return aw.addFile(entryName, fi, f)
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+}
+
+func (a tarArchive) addDir(name string, fi fs.FileInfo) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name: name + "/",
+		Mode: int64(fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+		Format: tar.FormatPAX,
+	})
+}
+
+// addFile writes exactly the size in fi, so a file that grows while it is
+// copied is cut short and one that shrinks is an error.
+func (a tarArchive) addFile(name string, fi fs.FileInfo, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Mode: int64(fi.Mode().Perm()),
+		Size: fi.Size(),
+		ModTime: fi.ModTime(),
+		Format: tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.tw, r, fi.Size())
+	return err
+}
+
+func (a tarArchive) Close() error {
+	return a.tw.Close()
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+// newZipArchive deflates files at the server's gzip level.
+func newZipArchive(w io.Writer, level int) zipArchive {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	return zipArchive{zw}
+}
+
+func (a zipArchive) addDir(name string, fi fs.FileInfo) error {
+	fh := &zip.FileHeader{Name: name + "/", Modified: fi.ModTime()}
+	fh.SetMode(fi.Mode().Perm() | os.ModeDir)
+	_, err := a.zw.CreateHeader(fh)
+	return err
+}
+
+func (a zipArchive) addFile(name string, fi fs.FileInfo, r io.Reader) error {
+	fh := &zip.FileHeader{Name: name, Modified: fi.ModTime(), Method: zip.Deflate}
+	fh.SetMode(fi.Mode().Perm())
+	dst, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+func (a zipArchive) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// archiveTree is a small tree with a link out of its root, all with the
+// same mtime.
+func archiveTree(t *testing.T) (root string, mtime time.Time) {
+	t.Helper()
+	parent := t.TempDir()
+	root = filepath.Join(parent, "tree")
+	files := map[string]string{"a.txt": "alpha", "d/b.txt": "bravo", "d/e/c.txt": "charlie"}
+	writeFiles(t, root, files)
+	writeFiles(t, parent, map[string]string{"secret": "outside"})
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	mtime = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	for _, name := range []string{".", "a.txt", "d", "d/b.txt", "d/e", "d/e/c.txt"} {
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, mtime
+}
+
+func TestArchiveTar(t *testing.T) {
+	root, mtime := archiveTree(t)
+	s := newTestServer(t, root)
+
+	w := get(s.archiveHandler, "/archive/")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("got %d with Content-Type %q, want 200 application/x-tar", w.Code, w.Header().Get("Content-Type"))
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename=tree.tar" {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+	if !bytes.HasSuffix(w.Body.Bytes(), make([]byte, 2*512)) {
+		t.Error("the archive doesn't end with a tar trailer")
+	}
+	var names []string
+	contents := map[string]string{}
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", hdr.Name, hdr.ModTime, mtime)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(b)
+		}
+	}
+	slices.Sort(names)
+	// The link out of the root is left out, as a listing leaves it.
+	want := []string{"tree/", "tree/a.txt", "tree/d/", "tree/d/b.txt", "tree/d/e/", "tree/d/e/c.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("entries %q, want %q", names, want)
+	}
+	for name, data := range map[string]string{"tree/a.txt": "alpha", "tree/d/b.txt": "bravo", "tree/d/e/c.txt": "charlie"} {
+		if contents[name] != data {
+			t.Errorf("%s holds %q, want %q", name, contents[name], data)
+		}
+	}
+
+	// A subdirectory is stored under its own name.
+	tr = tar.NewReader(get(s.archiveHandler, "/archive/d/e").Body)
+	names = nil
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"e/", "e/c.txt"}) {
+		t.Errorf("entries under d/e %q, want e/ and e/c.txt", names)
+	}
+
+	decodeError(t, get(s.archiveHandler, "/archive/a.txt"), http.StatusBadRequest)
+	decodeError(t, get(s.archiveHandler, "/archive/missing"), http.StatusNotFound)
+	decodeError(t, get(s.archiveHandler, "/archive/?sort=size"), http.StatusBadRequest)
+}
+
+func TestArchiveZip(t *testing.T) {
+	root, mtime := archiveTree(t)
+	s := newTestServer(t, root)
+
+	w := get(s.archiveHandler, "/archive/d?format=zip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("got %d with Content-Type %q, want 200 application/zip", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if !f.Modified.Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", f.Name, f.Modified, mtime)
+		}
+	}
+	slices.Sort(names)
+	if want := []string{"d/", "d/b.txt", "d/e/", "d/e/c.txt"}; !slices.Equal(names, want) {
+		t.Errorf("entries %q, want %q", names, want)
+	}
+	rc, err := zr.Open("d/e/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || string(b) != "charlie" {
+		t.Errorf("d/e/c.txt holds %q, %v", b, err)
+	}
+}
+
+func TestArchiveAbortsOnWalkError(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 50 {
+		files[fmt.Sprintf("f%02d.txt", i)] = "x"
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+	s.maxEntries = 10
+
+	for _, format := range []string{"tar", "zip"} {
+		w, aborted := getAborted(t, s.archiveHandler, "/archive/?format="+format)
+		if !aborted {
+			t.Errorf("%s: an archive cut short was finished, not aborted", format)
+		}
+		// Without its trailer the archive can't pass for complete.
+		switch format {
+		case "tar":
+			// tar.Reader takes a clean end of input for the end of the
+			// archive, so look for the two zero blocks Close writes.
+			if bytes.HasSuffix(w.Body.Bytes(), make([]byte, 2*512)) {
+				t.Error("tar: ends with the trailer")
+			}
+		case "zip":
+			if _, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err == nil {
+				t.Error("zip: opened as a complete archive")
+			}
+		}
+	}
+}
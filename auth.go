@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bearerAuthMiddleware refuses requests that don't carry token in an
+// Authorization: Bearer header.
+func bearerAuthMiddleware(token string, next http.Handler) http.Handler {
+	want := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, got, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goserver"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// htpasswd holds the users from an htpasswd file of bcrypt hashes, as
+// written by htpasswd -B. The file is read again whenever its mtime
+// changes or reload is called.
+type htpasswd struct {
+	path string
+
+	mu sync.RWMutex
+	users map[string][]byte
+	modTime time.Time
+}
+
+// loadHtpasswd reads the users in the htpasswd file at path.
+func loadHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload reads the file again. On error the users already loaded are kept.
+func (h *htpasswd) reload() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Remember the mtime even for a bad file, so it is complained about
+	// once rather than on every request until it is fixed.
+	h.modTime = fi.ModTime()
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	h.users = users
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: only bcrypt hashes are supported", i+1, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, nil
+}
+
+// reloadIfChanged rereads the file if its mtime has moved since the last
+// load.
+func (h *htpasswd) reloadIfChanged(logger *slog.Logger) {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return
+	}
+	h.mu.RLock()
+	changed := !fi.ModTime().Equal(h.modTime)
+	h.mu.RUnlock()
+	if changed {
+		if err := h.reload(); err != nil {
+			logger.Warn("reloading htpasswd file", "err", err)
+		}
+	}
+}
+
+// reloadOnHangup rereads the file on every SIGHUP until ctx is cancelled.
+func (h *htpasswd) reloadOnHangup(ctx context.Context, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := h.reload(); err != nil {
+					logger.Warn("reloading htpasswd file", "err", err)
+					continue
+				}
+				logger.Info("reloaded htpasswd file", "path", h.path)
+			}
+		}
+	}()
+}
+
+// unknownUserHash is checked against for users not in the file, so a
+// wrong name takes as long to refuse as a wrong password.
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// check reports whether password is right for user.
+func (h *htpasswd) check(user, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		hash = unknownUserHash()
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+}
+
+// basicAuthMiddleware refuses requests without the Basic credentials of a
+// user in users.
+func basicAuthMiddleware(logger *slog.Logger, users *htpasswd, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users.reloadIfChanged(logger)
+		user, password, ok := r.BasicAuth()
+		if !ok || !users.check(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="goserver", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBearerAuthMiddleware(t *testing.T) {
+	h := bearerAuthMiddleware("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for header, want := range map[string]int{
+		"Bearer s3cret": http.StatusOK,
+		"bearer s3cret": http.StatusOK,
+		"": http.StatusUnauthorized,
+		"Bearer wrong": http.StatusUnauthorized,
+		"Bearer s3cret2": http.StatusUnauthorized,
+		"Bearer": http.StatusUnauthorized,
+		"Basic s3cret": http.StatusUnauthorized,
+	} {
+		headers := map[string]string{}
+		if header != "" {
+			headers["Authorization"] = header
+		}
+		w := getWith(h.ServeHTTP, "/", headers)
+		if w.Code != want {
+			t.Errorf("Authorization %q: %d, want %d", header, w.Code, want)
+		}
+		if want == http.StatusUnauthorized {
+			decodeError(t, w, http.StatusUnauthorized)
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Authorization %q: no WWW-Authenticate challenge", header)
+			}
+		}
+	}
+}
+
+// writeHtpasswd writes an htpasswd file of bcrypt hashes for users.
+func writeHtpasswd(t *testing.T, path string, users map[string]string) {
+	t.Helper()
+	var data strings.Builder
+	data.WriteString("# users\n")
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&data, "%s:%s\n", user, hash)
+	}
+	if err := os.WriteFile(path, []byte(data.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getBasic sends a GET to h with the given Basic credentials, or none if
+// user is empty.
+func getBasic(h http.Handler, user, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "wonderland", "bob": "builder"})
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := basicAuthMiddleware(logger, users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		user, password string
+		want int
+	}{
+		{"alice", "wonderland", http.StatusOK},
+		{"bob", "builder", http.StatusOK},
+		{"alice", "builder", http.StatusUnauthorized},
+		{"carol", "wonderland", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		w := getBasic(h, tt.user, tt.password)
+		if w.Code != tt.want {
+			t.Errorf("%q:%q: %d, want %d", tt.user, tt.password, w.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%q: challenge %q", tt.user, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// A changed file is read again before the next request.
+	writeHtpasswd(t, path, map[string]string{"alice": "looking-glass"})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if w := getBasic(h, "alice", "looking-glass"); w.Code != http.StatusOK {
+		t.Errorf("new password after the file changed: %d", w.Code)
+	}
+	if w := getBasic(h, "bob", "builder"); w.Code != http.StatusUnauthorized {
+		t.Errorf("removed user: %d", w.Code)
+	}
+
+	// A broken file keeps the users already loaded.
+	if err := os.WriteFile(path, []byte("alice:plaintext\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if w := getBasic(h, "alice", "looking-glass"); w.Code != http.StatusOK {
+		t.Errorf("after the file broke: %d, want the loaded users kept", w.Code)
+	}
+	if _, err := loadHtpasswd(path); err == nil {
+		t.Error("loadHtpasswd accepted a plaintext password")
+	}
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHtpasswdReloadsOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "old"})
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	users.reloadOnHangup(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Keep the mtime, so only the signal can bring the change in.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeHtpasswd(t, path, map[string]string{"alice": "new"})
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !users.check("alice", "new") {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP didn't reload the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"example/josh/goserver/metadata"
+)
+
+// walkUsage describes the walk subcommand.
+const walkUsage = "usage: goserver [flags] walk path [query]\n" +
+	"query takes the metadata endpoint's parameters, as in \"sort=size&depth=1\""
+
+// runWalk serves one request for path through the metadata handler and
+// writes the body to stdout instead of a client, so scripts get the same
+// output as over HTTP. Error responses go to stderr. It returns the
+// process's exit code, 130 after an interrupt as a shell would report.
+func runWalk(s *server, args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, walkUsage)
+		return 2
+	}
+	target, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// A file is walked as the one entry of its directory.
+	u := &url.URL{Path: "/"}
+	s.root = target
+	if !fi.IsDir() {
+		s.root = filepath.Dir(target)
+		u.Path += filepath.Base(target)
+	}
+	s.fsys = metadata.LimitOpenFiles(os.DirFS(s.root), s.openFiles)
+	if len(args) == 2 {
+		u.RawQuery = args[1]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	w := &stdoutResponseWriter{header: http.Header{}, out: bufio.NewWriter(os.Stdout)}
+	aborted := serveAborting(s.fileMetadataHandler, w, r)
+	if err := w.out.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// An interrupted walk is abandoned without a response, so the
+	// status may never have been set.
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return 130
+	}
+	if aborted || w.status == 0 || w.status >= http.StatusBadRequest {
+		return 1
+	}
+	return 0
+}
+
+// serveAborting runs handler, reporting whether it gave up on the response
+// with http.ErrAbortHandler, as a streamed format does when the walk fails
+// after its output has begun.
+func serveAborting(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+	handler(w, r)
+	return false
+}
+
+// stdoutResponseWriter is the http.ResponseWriter runWalk hands the
+// handler. The body goes to out, or to stderr once an error status has
+// been written.
+type stdoutResponseWriter struct {
+	header http.Header
+	status int
+	out *bufio.Writer
+}
+
+func (w *stdoutResponseWriter) Header() http.Header { return w.header }
+
+func (w *stdoutResponseWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	if code >= http.StatusBadRequest {
+		w.out = bufio.NewWriter(os.Stderr)
+	}
+}
+
+func (w *stdoutResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.out.Write(p)
+}
+
+// FlushError lets streamed formats reach stdout as they are walked.
+func (w *stdoutResponseWriter) FlushError() error {
+	return w.out.Flush()
+}
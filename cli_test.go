@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example/josh/goserver/metadata"
+)
+
+// captureWalk runs the walk subcommand with args against s, returning its
+// exit code and what it wrote to stdout and stderr.
+func captureWalk(t *testing.T, s *server, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	outFile, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFile, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOut, oldErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	code = runWalk(s, args)
+	os.Stdout, os.Stderr = oldOut, oldErr
+
+	read := func(f *os.File) string {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return string(b)
+	}
+	return code, read(outFile), read(errFile)
+}
+
+func TestRunWalk(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "big.txt": strings.Repeat("b", 100), "d/c.txt": "cc"})
+
+	code, out, errOut := captureWalk(t, newTestServer(t, t.TempDir()), root, "sort=size&order=desc")
+	if code != 0 || errOut != "" {
+		t.Fatalf("exit %d, stderr %q", code, errOut)
+	}
+	var md metadata.FileMetadata
+	if err := json.Unmarshal([]byte(out), &md); err != nil {
+		t.Fatalf("decoding stdout %q: %v", out, err)
+	}
+	if md.Path != "." || md.FileCount != 3 || md.FileSizeGzipped == nil {
+		t.Errorf("root %q with %d files, gzipped %v; want the whole directory with its gzip size", md.Path, md.FileCount, md.FileSizeGzipped)
+	}
+	var names []string
+	for _, f := range md.Files {
+		names = append(names, f.Filename)
+	}
+	if got := strings.Join(names, " "); got != "big.txt d a.txt" {
+		t.Errorf("files %q, want big.txt d a.txt from the query's sort", got)
+	}
+
+	// A file is listed on its own, and the server's settings apply.
+	s := newTestServer(t, t.TempDir())
+	s.noGzip = true
+	code, out, _ = captureWalk(t, s, filepath.Join(root, "big.txt"))
+	md = metadata.FileMetadata{}
+	if err := json.Unmarshal([]byte(out), &md); code != 0 || err != nil {
+		t.Fatalf("exit %d decoding %q: %v", code, out, err)
+	}
+	if md.Filename != "big.txt" || md.FileSize != 100 || md.FileSizeGzipped != nil {
+		t.Errorf("got %s of %d bytes, gzipped %v; want big.txt's 100 bytes with no gzip size", md.Filename, md.FileSize, md.FileSizeGzipped)
+	}
+
+	// Streamed formats come out as they would over HTTP.
+	code, out, _ = captureWalk(t, newTestServer(t, t.TempDir()), root, "format=ndjson")
+	if lines := strings.Count(out, "\n"); code != 0 || lines != 5 {
+		t.Errorf("ndjson: exit %d with %d lines, want 0 with one per entry:\n%s", code, lines, out)
+	}
+}
+
+func TestRunWalkFails(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "b.txt": "b", "d/c.txt": "c"})
+
+	if code, _, errOut := captureWalk(t, newTestServer(t, t.TempDir())); code != 2 || !strings.Contains(errOut, "usage") {
+		t.Errorf("no path: exit %d, stderr %q; want 2 with the usage", code, errOut)
+	}
+	if code, _, errOut := captureWalk(t, newTestServer(t, t.TempDir()), filepath.Join(root, "missing")); code != 1 || errOut == "" {
+		t.Errorf("missing path: exit %d, stderr %q; want 1 with the error", code, errOut)
+	}
+
+	// An error response goes to stderr alone.
+	code, out, errOut := captureWalk(t, newTestServer(t, t.TempDir()), root, "depth=deep")
+	var e apiError
+	if err := json.Unmarshal([]byte(errOut), &e); code != 1 || out != "" || err != nil || e.Code != http.StatusBadRequest {
+		t.Errorf("bad query: exit %d, stdout %q, stderr %q; want 1 with a 400 on stderr", code, out, errOut)
+	}
+
+	// So does the end of a stream cut short.
+	s := newTestServer(t, t.TempDir())
+	s.maxEntries = 2
+	code, out, errOut = captureWalk(t, s, root, "format=ndjson")
+	if code != 1 || !strings.Contains(out, `"code":413`) {
+		t.Errorf("aborted stream: exit %d, stdout %q, stderr %q; want 1 ending in a 413 record", code, out, errOut)
+	}
+}
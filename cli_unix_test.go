@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunWalkInterrupted(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 2000 {
+		files[fmt.Sprintf("d%02d/f%04d.txt", i%20, i)] = strings.Repeat("x", 4096)
+	}
+	writeFiles(t, root, files)
+
+	// Holding the signal here keeps an interrupt sent before runWalk
+	// listens for one from killing the test.
+	held := make(chan os.Signal, 1)
+	signal.Notify(held, os.Interrupt)
+	defer signal.Stop(held)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				syscall.Kill(os.Getpid(), syscall.SIGINT)
+			}
+		}
+	}()
+	code, _, errOut := captureWalk(t, newTestServer(t, t.TempDir()), root, "checksum=sha256")
+	close(done)
+	// Let the last interrupts sent land on held before it is let go.
+	<-stopped
+	for settled := false; !settled; {
+		select {
+		case <-held:
+		case <-time.After(100 * time.Millisecond):
+			settled = true
+		}
+	}
+	if code != 130 || !strings.Contains(errOut, "interrupted") {
+		t.Errorf("exit %d, stderr %q; want 130 after an interrupt", code, errOut)
+	}
+}
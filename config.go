@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config", "", "YAML or JSON file of settings keyed by flag name, such as addr or gzip-level; flags and GMS_ environment variables take precedence")
+
+// envPrefix starts the environment variable for every flag: -gzip-level
+// is GMS_GZIP_LEVEL.
+const envPrefix = "GMS_"
+
+// legacyEnv names the unprefixed variables that set a flag before every
+// flag had a GMS_ one. They rank with the environment, below GMS_.
+var legacyEnv = map[string]string{
+	"addr": "ADDR",
+	"auth-token": "AUTH_TOKEN",
+}
+
+// envName returns the environment variable that sets the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// setting is a flag value found outside the command line, with where it
+// came from for error messages.
+type setting struct {
+	value string
+	source string
+}
+
+// configure fills in the flags that weren't given on the command line,
+// from the environment and then from the config file, so the precedence
+// is flag, environment, file, default. ADDR and AUTH_TOKEN count as
+// environment too, under GMS_ADDR and GMS_AUTH_TOKEN. The config file may
+// itself be named by GMS_CONFIG.
+func configure(fs *flag.FlagSet, getenv func(string) string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	settings := make(map[string]setting)
+	configPath := fs.Lookup("config").Value.String()
+	if !given["config"] {
+		if v := getenv(envName("config")); v != "" {
+			configPath = v
+		}
+	}
+	if configPath != "" {
+		values, err := loadConfig(configPath)
+		if err != nil {
+			return err
+		}
+		for key, v := range values {
+			if key == "config" || fs.Lookup(key) == nil {
+				return fmt.Errorf("%s: unknown config key %q", configPath, key)
+			}
+			settings[key] = setting{v, fmt.Sprintf("config key %s in %s", key, configPath)}
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		for _, key := range []string{legacyEnv[f.Name], envName(f.Name)} {
+			if v := getenv(key); key != "" && v != "" {
+				settings[f.Name] = setting{v, key}
+			}
+		}
+	})
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		s := settings[name]
+		if err := fs.Set(name, s.value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", s.value, s.source, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads a config file into flag values, choosing JSON or YAML
+// by its extension. Each key must hold a single value.
+func loadConfig(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: config file must end in .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("%s: %s must be a single value", path, key)
+		case nil:
+			return nil, fmt.Errorf("%s: %s has no value", path, key)
+		}
+		values[key] = fmt.Sprint(v)
+	}
+	return values, nil
+}
+
+// usage prints the flag defaults along with how else they can be set.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [root | walk path [query]]\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nEvery flag can also be set with an environment variable named after it,\n"+
+		"such as %s for -gzip-level, or in the -config file. A flag on the\n"+
+		"command line wins over the environment, which wins over the file.\n", envName("gzip-level"))
+}
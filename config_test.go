@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags is a flag set laid out like the command line's, parsed from
+// args.
+type testFlags struct {
+	fs *flag.FlagSet
+	addr *string
+	level *string
+	concurrency *int
+	timeout *time.Duration
+	hidden *bool
+}
+
+func newTestFlags(t *testing.T, args ...string) testFlags {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := testFlags{
+		fs: fs,
+		addr: fs.String("addr", ":8080", ""),
+		level: fs.String("gzip-level", "default", ""),
+		concurrency: fs.Int("max-concurrency", 16, ""),
+		timeout: fs.Duration("request-timeout", 0, ""),
+		hidden: fs.Bool("hidden", false, ""),
+	}
+	fs.String("config", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func noEnv(string) string { return "" }
+
+// writeConfig writes a config file named name and returns its path.
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConfigFile(t *testing.T) {
+	files := map[string]string{
+		"gms.yaml": "addr: 127.0.0.1:9000\ngzip-level: 9\nmax-concurrency: 4\nrequest-timeout: 5s\nhidden: true\n",
+		"gms.json": `{"addr": "127.0.0.1:9000", "gzip-level": 9, "max-concurrency": 4, "request-timeout": "5s", "hidden": true}`,
+	}
+	for name, data := range files {
+		path := writeConfig(t, name, data)
+		f := newTestFlags(t, "-config", path)
+		if err := configure(f.fs, noEnv); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if *f.addr != "127.0.0.1:9000" || *f.level != "9" || *f.concurrency != 4 || *f.timeout != 5*time.Second || !*f.hidden {
+			t.Errorf("%s: addr %q, level %q, concurrency %d, timeout %s, hidden %t", name, *f.addr, *f.level, *f.concurrency, *f.timeout, *f.hidden)
+		}
+
+		// A flag on the command line wins over the file, which still
+		// sets the rest.
+		f = newTestFlags(t, "-config", path, "-addr", ":7000", "-hidden=false")
+		if err := configure(f.fs, noEnv); err != nil {
+			t.Fatal(err)
+		}
+		if *f.addr != ":7000" || *f.hidden || *f.concurrency != 4 {
+			t.Errorf("%s with flags: addr %q, hidden %t, concurrency %d; want :7000, false and 4 from the file", name, *f.addr, *f.hidden, *f.concurrency)
+		}
+	}
+
+	// Without a file, the defaults stand.
+	f := newTestFlags(t)
+	if err := configure(f.fs, noEnv); err != nil || *f.addr != ":8080" || *f.concurrency != 16 {
+		t.Errorf("no config: addr %q, concurrency %d, %v", *f.addr, *f.concurrency, err)
+	}
+
+	for _, tt := range []struct {
+		name, data, want string
+	}{
+		{"typo.yaml", "adr: :9000\n", `unknown config key "adr"`},
+		{"nested.yaml", "addr: {host: x}\n", "addr must be a single value"},
+		{"self.yaml", "config: other.yaml\n", `unknown config key "config"`},
+		{"list.json", `{"addr": [":1", ":2"]}`, "addr must be a single value"},
+		{"null.yaml", "addr:\n", "addr has no value"},
+		{"bad.yaml", "max-concurrency: lots\n", "config key max-concurrency in"},
+		{"broken.json", `{"addr": `, "broken.json"},
+		{"gms.toml", `addr = ":9000"`, "must end in .json, .yaml or .yml"},
+	} {
+		f := newTestFlags(t, "-config", writeConfig(t, tt.name, tt.data))
+		if err := configure(f.fs, noEnv); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one mentioning %q", tt.name, err, tt.want)
+		}
+	}
+	f = newTestFlags(t, "-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	if err := configure(f.fs, noEnv); err == nil {
+		t.Error("a missing config file was accepted")
+	}
+}
+
+// envMap is a getenv over a fixed environment.
+func envMap(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	env := map[string]string{
+		"GMS_ADDR": "127.0.0.1:9100",
+		"GMS_GZIP_LEVEL": "1",
+		"GMS_MAX_CONCURRENCY": "2",
+		"GMS_REQUEST_TIMEOUT": "3s",
+	}
+	f := newTestFlags(t)
+	if err := configure(f.fs, envMap(env)); err != nil {
+		t.Fatal(err)
+	}
+	if *f.addr != "127.0.0.1:9100" || *f.level != "1" || *f.concurrency != 2 || *f.timeout != 3*time.Second || *f.hidden {
+		t.Errorf("addr %q, level %q, concurrency %d, timeout %s, hidden %t", *f.addr, *f.level, *f.concurrency, *f.timeout, *f.hidden)
+	}
+
+	// Flag over environment over file over default.
+	env["GMS_CONFIG"] = writeConfig(t, "gms.yaml", "addr: :1\nmax-concurrency: 8\nhidden: true\n")
+	f = newTestFlags(t, "-gzip-level", "9")
+	if err := configure(f.fs, envMap(env)); err != nil {
+		t.Fatal(err)
+	}
+	if *f.level != "9" || *f.addr != "127.0.0.1:9100" || *f.concurrency != 2 || !*f.hidden || *f.timeout != 3*time.Second {
+		t.Errorf("layered: level %q, addr %q, concurrency %d, hidden %t, timeout %s; want 9 from the flag, the rest from the environment and hidden from the file", *f.level, *f.addr, *f.concurrency, *f.hidden, *f.timeout)
+	}
+	// -config on the command line wins over GMS_CONFIG.
+	f = newTestFlags(t, "-config", writeConfig(t, "other.json", `{"hidden": false, "max-concurrency": 5}`))
+	delete(env, "GMS_MAX_CONCURRENCY")
+	if err := configure(f.fs, envMap(env)); err != nil || *f.hidden || *f.concurrency != 5 {
+		t.Errorf("-config over GMS_CONFIG: hidden %t, concurrency %d, %v", *f.hidden, *f.concurrency, err)
+	}
+
+	// ADDR is environment too, so it wins over the file, and GMS_ADDR
+	// wins over it.
+	legacy := map[string]string{"ADDR": "127.0.0.1:9200", "GMS_CONFIG": writeConfig(t, "addr.yaml", "addr: :1\n")}
+	f = newTestFlags(t)
+	if err := configure(f.fs, envMap(legacy)); err != nil || *f.addr != "127.0.0.1:9200" {
+		t.Errorf("ADDR over the file: addr %q, %v; want 127.0.0.1:9200", *f.addr, err)
+	}
+	legacy["GMS_ADDR"] = "127.0.0.1:9300"
+	f = newTestFlags(t)
+	if err := configure(f.fs, envMap(legacy)); err != nil || *f.addr != "127.0.0.1:9300" {
+		t.Errorf("GMS_ADDR over ADDR: addr %q, %v; want 127.0.0.1:9300", *f.addr, err)
+	}
+
+	f = newTestFlags(t)
+	err := configure(f.fs, envMap(map[string]string{"GMS_MAX_CONCURRENCY": "many"}))
+	if err == nil || !strings.Contains(err.Error(), "GMS_MAX_CONCURRENCY") {
+		t.Errorf("bad environment value: error %v, want one naming the variable", err)
+	}
+}
+
+func TestEveryFlagHasAnEnvironmentVariable(t *testing.T) {
+	if got := envName("max-gzip-bytes"); got != "GMS_MAX_GZIP_BYTES" {
+		t.Errorf("envName(max-gzip-bytes) = %q", got)
+	}
+	// Each flag's variable is distinct, so none shadows another.
+	seen := map[string]string{}
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		if other, ok := seen[name]; ok {
+			t.Errorf("-%s and -%s both read %s", f.Name, other, name)
+		}
+		seen[name] = f.Name
+	})
+	if len(seen) < 10 {
+		t.Errorf("only %d flags registered", len(seen))
+	}
+}
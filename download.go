@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// downloadHandler serves the contents of the regular file at the path
+// after /download/, with Range and conditional requests handled by
+// http.ServeContent. With ?gzip=true it is compressed on the way instead.
+func (s *server) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	name, err := resolvePath(s.root, strings.TrimPrefix(r.URL.Path, "/download"))
+	if err != nil {
+		writeResolveError(w, r, err)
+		return
+	}
+	var compress bool
+	if v := r.URL.Query().Get("gzip"); v != "" {
+		if compress, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid gzip %q: must be true or false", v))
+			return
+		}
+	}
+
+	file, fi, ok := s.openRegular(w, r, name)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	if compress {
+		s.serveGzipped(w, r, name, file, fi)
+		return
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		slog.ErrorContext(r.Context(), "download file is not seekable", "path", name)
+		writeError(w, http.StatusInternalServerError, "Error reading file")
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
+
+// openRegular opens name for downloading, answering the request itself and
+// returning false if that fails or name isn't a regular file. The type is
+// checked before opening, since opening a pipe blocks.
+func (s *server) openRegular(w http.ResponseWriter, r *http.Request, name string) (fs.File, fs.FileInfo, bool) {
+	fi, err := fs.Stat(s.fsys, name)
+	if err == nil && !fi.Mode().IsRegular() {
+		msg := "Not a regular file"
+		if fi.IsDir() {
+			msg = "Cannot download a directory"
+		}
+		writeError(w, http.StatusBadRequest, msg)
+		return nil, nil, false
+	}
+	var file fs.File
+	if err == nil {
+		file, err = s.fsys.Open(name)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "File not found")
+			return nil, nil, false
+		}
+		slog.ErrorContext(r.Context(), "opening download", "path", name, "err", err)
+		writeError(w, http.StatusInternalServerError, "Error reading file")
+		return nil, nil, false
+	}
+	return file, fi, true
+}
+
+// serveGzipped streams file compressed at the server's gzip level, as a
+// .gz attachment. The compressed length isn't known until the end, so
+// ranges are not supported.
+func (s *server) serveGzipped(w http.ResponseWriter, r *http.Request, name string, file fs.File, fi fs.FileInfo) {
+	h := w.Header()
+	contentType := mime.TypeByExtension(path.Ext(fi.Name()))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Encoding", "gzip")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name() + ".gz"}))
+	h.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	gz, err := gzip.NewWriterLevel(w, s.gzipLevel)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "compressing download", "path", name, "err", err)
+		return
+	}
+	if _, err := io.Copy(gz, file); err != nil {
+		slog.WarnContext(r.Context(), "compressed download ended early", "path", name, "err", err)
+		return
+	}
+	gz.Close()
+}
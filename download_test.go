@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	data := "0123456789abcdefghij"
+	writeFiles(t, parent, map[string]string{"secret": "outside", "root/d/data.txt": data, "root/page.html": "<p>hi</p>"})
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, root)
+
+	w := get(s.downloadHandler, "/download/d/data.txt")
+	if w.Code != http.StatusOK || w.Body.String() != data {
+		t.Fatalf("got %d %q, want 200 %q", w.Code, w.Body, data)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q, want text/plain; charset=utf-8", ct)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(data)) {
+		t.Errorf("Content-Length %q, want %d", cl, len(data))
+	}
+	if ct := get(s.downloadHandler, "/download/page.html").Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("page.html: Content-Type %q", ct)
+	}
+
+	w = getWith(s.downloadHandler, "/download/d/data.txt", map[string]string{"Range": "bytes=5-9"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+		t.Errorf("range: got %d %q, want 206 56789", w.Code, w.Body)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 5-9/20" {
+		t.Errorf("Content-Range %q, want bytes 5-9/20", cr)
+	}
+	lm := get(s.downloadHandler, "/download/d/data.txt").Header().Get("Last-Modified")
+	if w := getWith(s.downloadHandler, "/download/d/data.txt", map[string]string{"If-Modified-Since": lm}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status %d, want 304", w.Code)
+	}
+
+	for target, status := range map[string]int{
+		"/download/d": http.StatusBadRequest,
+		"/download/": http.StatusBadRequest,
+		"/download/missing": http.StatusNotFound,
+		"/download/../secret": http.StatusNotFound,
+		"/download/out": http.StatusForbidden,
+	} {
+		decodeError(t, get(s.downloadHandler, target), status)
+	}
+
+	w = httptest.NewRecorder()
+	s.downloadHandler(w, httptest.NewRequest(http.MethodPost, "/download/d/data.txt", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: status %d, Allow %q; want 405 with GET, HEAD", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestDownloadGzipped(t *testing.T) {
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("compress me\n"), 10000)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"random.bin": string(random), "d/text.txt": string(text)})
+
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		s := newTestServer(t, root)
+		s.gzipLevel = level
+		for name, want := range map[string][]byte{"random.bin": random, "d/text.txt": text} {
+			w := get(s.downloadHandler, "/download/"+name+"?gzip=true")
+			if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("%s: got %d with Content-Encoding %q, want 200 gzip", name, w.Code, w.Header().Get("Content-Encoding"))
+			}
+			if cd, want := w.Header().Get("Content-Disposition"), `attachment; filename=`+filepath.Base(name)+".gz"; cd != want {
+				t.Errorf("%s: Content-Disposition %q, want %q", name, cd, want)
+			}
+			if w.Header().Get("Content-Length") != "" {
+				t.Errorf("%s: Content-Length %q before the compressed size is known", name, w.Header().Get("Content-Length"))
+			}
+			if name == "d/text.txt" {
+				sizes[level] = w.Body.Len()
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s: reading the gzip stream to its end: %v", name, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: decompressed %d bytes that differ from the %d in the file", name, len(got), len(want))
+			}
+		}
+	}
+	// The server's level is the one used.
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("text.txt compressed to %d bytes at best compression and %d at best speed", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+
+	s := newTestServer(t, root)
+	decodeError(t, get(s.downloadHandler, "/download/d?gzip=true"), http.StatusBadRequest)
+	decodeError(t, get(s.downloadHandler, "/download/random.bin?gzip=yes"), http.StatusBadRequest)
+	if w := get(s.downloadHandler, "/download/random.bin?gzip=false"); w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), random) {
+		t.Errorf("gzip=false: Content-Encoding %q with %d bytes, want the file as it is", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+}
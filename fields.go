@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"example/josh/goserver/metadata"
+)
+
+// metadataFields are the JSON names of FileMetadata's fields, the values
+// ?fields accepts.
+var metadataFields = jsonFieldNames(reflect.TypeFor[metadata.FileMetadata]())
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseFields reads a ?fields list, rejecting names FileMetadata doesn't
+// have.
+func parseFields(v string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	for _, name := range splitList(v) {
+		if !metadataFields[name] {
+			return nil, fmt.Errorf("invalid field %q", name)
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// timeFields are the FileMetadata fields holding timestamps.
+var timeFields = []string{"last_modified_date", "created_date", "changed_date"}
+
+// formatTime renders t for ?time-format: epoch seconds or milliseconds as a
+// number, or RFC 3339 by default.
+func formatTime(t time.Time, format string) any {
+	switch format {
+	case "unix":
+		return t.Unix()
+	case "unixmilli":
+		return t.UnixMilli()
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// reshapes reports whether nodes need converting with reshape before they
+// are encoded.
+func (o renderOptions) reshapes() bool {
+	return o.fields != nil || o.timeFormat != ""
+}
+
+// reshape is m as a map, restricted to render.fields if set and with its
+// timestamps in render.timeFormat, applied to every node below it.
+// Children are only kept if "files" is one of the fields.
+func reshape(m metadata.FileMetadata, render renderOptions) (map[string]any, error) {
+	files := m.Files
+	m.Files = nil
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any, len(all))
+	for name, v := range all {
+		if render.fields == nil || render.fields[name] {
+			out[name] = v
+		}
+	}
+	if render.timeFormat != "" {
+		for _, name := range timeFields {
+			v, ok := out[name].(json.RawMessage)
+			if !ok {
+				continue
+			}
+			var t time.Time
+			if err := json.Unmarshal(v, &t); err != nil {
+				return nil, err
+			}
+			out[name] = formatTime(t, render.timeFormat)
+		}
+	}
+
+	if _, ok := out["files"]; !ok {
+		return out, nil
+	}
+	if files == nil {
+		out["files"] = nil
+		return out, nil
+	}
+	children := make([]map[string]any, 0, len(files))
+	for _, f := range files {
+		child, err := reshape(f, render)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	out["files"] = children
+	return out, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// decodeNodes decodes a JSON tree response as nested maps.
+func decodeNodes(t *testing.T, h http.HandlerFunc, target string) map[string]any {
+	t.Helper()
+	w := get(h, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, w.Code, w.Body)
+	}
+	var node map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &node); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return node
+}
+
+// checkKeys checks that node, and every node in its files, has exactly the
+// keys want, returning how many nodes it checked.
+func checkKeys(t *testing.T, node map[string]any, want []string) int {
+	t.Helper()
+	if got := slices.Sorted(maps.Keys(node)); !slices.Equal(got, want) {
+		t.Errorf("%v: keys %q, want %q", node["filename"], got, want)
+	}
+	n := 1
+	files, _ := node["files"].([]any)
+	for _, f := range files {
+		n += checkKeys(t, f.(map[string]any), want)
+	}
+	return n
+}
+
+func TestFieldsParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "b", "d/e/c.txt": "c"})
+	s := newTestServer(t, root)
+
+	// Without files only the requested node is sent.
+	node := decodeNodes(t, s.fileMetadataHandler, "/?fields=filename,file_size_gzipped")
+	if n := checkKeys(t, node, []string{"file_size_gzipped", "filename"}); n != 1 {
+		t.Errorf("%d nodes sent without files in the fields", n)
+	}
+
+	// With files every node keeps the same fields, and a file's files are
+	// null as they are in the full tree.
+	node = decodeNodes(t, s.fileMetadataHandler, "/?fields=filename,file_size_gzipped,files")
+	if n := checkKeys(t, node, []string{"file_size_gzipped", "filename", "files"}); n != 6 {
+		t.Errorf("%d nodes sent with files in the fields, want all 6", n)
+	}
+	if node["file_size_gzipped"] == nil {
+		t.Error("file_size_gzipped left out of the root")
+	}
+
+	full := decodeNodes(t, s.fileMetadataHandler, "/d/b.txt")
+	if len(full) <= 2 {
+		t.Errorf("without ?fields only %d keys", len(full))
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/?fields=filename,nope"), http.StatusBadRequest)
+	decodeError(t, get(s.fileMetadataHandler, "/?fields=filename&format=tree"), http.StatusBadRequest)
+}
+
+func TestTimeFormatParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"d/a.txt": "a"})
+	mtime := time.Date(2024, 2, 3, 4, 5, 6, 789_000_000, time.UTC)
+	for _, name := range []string{"d/a.txt", "d", "."} {
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, root)
+
+	for query, want := range map[string]any{
+		"": "2024-02-03T04:05:06.789Z",
+		"time-format=rfc3339": "2024-02-03T04:05:06.789Z",
+		"time-format=unix": float64(mtime.Unix()),
+		"time-format=unixmilli": float64(mtime.UnixMilli()),
+	} {
+		node := decodeNodes(t, s.fileMetadataHandler, "/d/a.txt?"+query)
+		if got := node["last_modified_date"]; got != want {
+			t.Errorf("%q: last_modified_date %v (%T), want %v", query, got, got, want)
+		}
+		// Nested nodes are converted too.
+		tree := decodeNodes(t, s.fileMetadataHandler, "/?"+query)
+		a := tree["files"].([]any)[0].(map[string]any)["files"].([]any)[0].(map[string]any)
+		if got := a["last_modified_date"]; got != want {
+			t.Errorf("%q: nested last_modified_date %v, want %v", query, got, want)
+		}
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/?time-format=iso"), http.StatusBadRequest)
+	decodeError(t, get(s.fileMetadataHandler, "/?time-format=unix&format=xml"), http.StatusBadRequest)
+}
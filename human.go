@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"example/josh/goserver/metadata"
+)
+
+// formatSize renders n bytes for people, with one decimal place past the
+// first unit: "512 B", "3.4 MiB". si selects powers of 1000 (kB, MB, ...)
+// instead of powers of 1024 (KiB, MiB, ...).
+func formatSize(n int64, si bool) string {
+	base, units := int64(1024), []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	if si {
+		base, units = 1000, []string{"kB", "MB", "GB", "TB", "PB", "EB"}
+	}
+	if n < base && n > -base {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / float64(base)
+	unit := 0
+	// Compare after rounding so 1023.96 KiB is shown as 1.0 MiB rather
+	// than 1024.0 KiB.
+	for math.Abs(math.Round(v*10)/10) >= float64(base) && unit < len(units)-1 {
+		v /= float64(base)
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", v, units[unit])
+}
+
+// addHumanSizes fills in the human-readable size fields of m and of
+// everything beneath it.
+func addHumanSizes(m *metadata.FileMetadata, si bool) {
+	m.FileSizeHuman = formatSize(m.FileSize, si)
+	m.CompressedSizeHuman = formatSize(m.CompressedSize, si)
+	for i := range m.Files {
+		addHumanSizes(&m.Files[i], si)
+	}
+}
+
+// byteUnits maps the size suffixes parseByteSize accepts, in lower case, to
+// their multipliers. Bare and B-suffixed prefixes are SI; the "i" forms are
+// binary.
+var byteUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "kib": 1 << 10, "ki": 1 << 10,
+	"m": 1e6, "mb": 1e6, "mib": 1 << 20, "mi": 1 << 20,
+	"g": 1e9, "gb": 1e9, "gib": 1 << 30, "gi": 1 << 30,
+	"t": 1e12, "tb": 1e12, "tib": 1 << 40, "ti": 1 << 40,
+	"p": 1e15, "pb": 1e15, "pib": 1 << 50, "pi": 1 << 50,
+}
+
+// parseByteSize reads a size such as "512", "10MB", "1.5 GiB" or "64k".
+func parseByteSize(v string) (int64, error) {
+	s := strings.TrimSpace(v)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	mult, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok || n*mult > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: want a number of bytes with an optional unit such as KB, MiB or G", v)
+	}
+	return int64(n * mult), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFormatSize(t *testing.T) {
+	for _, tt := range []struct {
+		n int64
+		si bool
+		want string
+	}{
+		{0, false, "0 B"},
+		{1, false, "1 B"},
+		{1023, false, "1023 B"},
+		{1024, false, "1.0 KiB"},
+		{1536, false, "1.5 KiB"},
+		{1<<20 - 1, false, "1.0 MiB"},
+		{1 << 20, false, "1.0 MiB"},
+		{3565158, false, "3.4 MiB"},
+		{1<<30 - 1, false, "1.0 GiB"},
+		{1 << 30, false, "1.0 GiB"},
+		{5 << 40, false, "5.0 TiB"},
+		{1<<63 - 1, false, "8.0 EiB"},
+		{-2048, false, "-2.0 KiB"},
+		{999, true, "999 B"},
+		{1000, true, "1.0 kB"},
+		{1500000, true, "1.5 MB"},
+		{999999999, true, "1.0 GB"},
+		{1e9, true, "1.0 GB"},
+	} {
+		if got := formatSize(tt.n, tt.si); got != tt.want {
+			t.Errorf("formatSize(%d, si %t) = %q, want %q", tt.n, tt.si, got, tt.want)
+		}
+	}
+}
+
+func TestHumanParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"d/a.txt": string(make([]byte, 1536))})
+	s := newTestServer(t, root)
+
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/")); md.FileSizeHuman != "" {
+		t.Errorf("human sizes without ?human: %q", md.FileSizeHuman)
+	}
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?human=true"))
+	a := md.Files[0].Files[0]
+	if a.FileSize != 1536 || a.FileSizeHuman != "1.5 KiB" || a.CompressedSizeHuman == "" {
+		t.Errorf("a.txt: %d bytes shown as %q, compressed %q", a.FileSize, a.FileSizeHuman, a.CompressedSizeHuman)
+	}
+	if md.FileSizeHuman != "1.5 KiB" {
+		t.Errorf("root shown as %q", md.FileSizeHuman)
+	}
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/d/a.txt?human=si")); md.FileSizeHuman != "1.5 kB" {
+		t.Errorf("human=si: %q, want 1.5 kB", md.FileSizeHuman)
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/?human=loud"), http.StatusBadRequest)
+}
+
+func TestParseByteSize(t *testing.T) {
+	for v, want := range map[string]int64{
+		"0": 0,
+		"512": 512,
+		"512B": 512,
+		"10MB": 10_000_000,
+		"10mb": 10_000_000,
+		"1.5 GiB": 3 << 29,
+		"64k": 64_000,
+		"2Ki": 2048,
+		" 3 MiB ": 3 << 20,
+		"1T": 1e12,
+	} {
+		if got, err := parseByteSize(v); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "MB", "ten", "10 XB", "-5", "1.2.3K", "10 M B", "9300P"} {
+		if n, err := parseByteSize(v); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", v, n)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"example/josh/goserver/metadata"
+)
+
+// writeTreeJSON writes m byte for byte as a json.Encoder with
+// SetIndent("", indent) would, a node at a time, so that no encoded copy
+// of the tree is built up in memory beside it.
+//
+// It is not a streaming encoder: m is the whole tree, walked first. The
+// nested format can't be written as the walk goes, because a directory's
+// sizes come before its files and are only known once they are all
+// walked, its files are sorted once they are all known, and the ETag
+// sent ahead of the body covers the whole tree. Use ?format=ndjson for
+// output that streams as the walk goes.
+func writeTreeJSON(w io.Writer, m metadata.FileMetadata, indent string) error {
+	bw := bufio.NewWriter(w)
+	if err := writeNodeJSON(bw, m, indent, 0); err != nil {
+		return err
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// writeNodeJSON encodes m without its files, then writes the children
+// in place of the null that leaves. Every quote inside a string is
+// escaped, so the only "files":null in the encoding is the field itself.
+// depth counts indentation levels, two for each level of the tree.
+func writeNodeJSON(w *bufio.Writer, m metadata.FileMetadata, indent string, depth int) error {
+	files := m.Files
+	m.Files = nil
+	node, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	prefix := strings.Repeat(indent, depth)
+	key := `"files":`
+	if indent != "" {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, node, prefix, indent); err != nil {
+			return err
+		}
+		node = buf.Bytes()
+		key += " "
+	}
+	before, after, ok := bytes.Cut(node, []byte(key+"null"))
+	if !ok || files == nil {
+		_, err := w.Write(node)
+		return err
+	}
+
+	w.Write(before)
+	w.WriteString(key)
+	w.WriteByte('[')
+	for i, f := range files {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		if indent != "" {
+			w.WriteByte('\n')
+			w.WriteString(prefix + indent + indent)
+		}
+		if err := writeNodeJSON(w, f, indent, depth+2); err != nil {
+			return err
+		}
+	}
+	if indent != "" && len(files) > 0 {
+		w.WriteByte('\n')
+		w.WriteString(prefix + indent)
+	}
+	w.WriteByte(']')
+	_, err = w.Write(after)
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"example/josh/goserver/metadata"
+)
+
+func TestWriteTreeJSONMatchesEncoder(t *testing.T) {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: mtime}
+	}
+	trees := map[string]fstest.MapFS{
+		"empty": {},
+		"flat": {"a.txt": file("a"), "b.txt": file("bb"), "c.bin": file("\x00\x01")},
+		"nested": {
+			"a/b/c/d.txt": file("deep"),
+			"a/b/e.txt": file("e"),
+			"a/f.txt": file("f"),
+			"g.txt": file("g"),
+		},
+		"empty dirs": {
+			"a": &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: mtime},
+			"b/c": &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		},
+		// The files key spelled out in names has to be escaped, or it
+		// would be taken for the field.
+		"awkward names": {
+			`"files":null`: file("x"),
+			`q"uote/"files": null`: file("y"),
+			"ünïcödé/<html>&.txt": file("z"),
+			"back\\slash": file("w"),
+		},
+	}
+	for name, fsys := range trees {
+		for _, depth := range []int{-1, 0, 1} {
+			opts := metadata.DefaultOptions()
+			opts.Depth = depth
+			md, err := metadata.Walk(context.Background(), fsys, ".", opts)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			for _, indent := range []string{"", " ", "  ", "\t", "    "} {
+				var want bytes.Buffer
+				enc := json.NewEncoder(&want)
+				enc.SetIndent("", indent)
+				if err := enc.Encode(md); err != nil {
+					t.Fatal(err)
+				}
+				var got bytes.Buffer
+				if err := writeTreeJSON(&got, md, indent); err != nil {
+					t.Fatalf("%s, depth %d, indent %q: %v", name, depth, indent, err)
+				}
+				if !bytes.Equal(got.Bytes(), want.Bytes()) {
+					t.Errorf("%s, depth %d, indent %q:\ngot  %s\nwant %s", name, depth, indent, got.Bytes(), want.Bytes())
+				}
+			}
+		}
+	}
+}
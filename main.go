@@ -1,148 +1,409 @@
 package main
 
 import (
-	"io"
-	"bytes"
 	"fmt"
 	"os"
 	"net/http"
 	"log"
 	"path/filepath"
-	"compress/gzip"
+	"flag"
+	"errors"
+	"net"
+	"context"
+	"os/signal"
+	"syscall"
 	"time"
-	"encoding/json"
-	"sync"
-)
+	"io"
+	"log/slog"
 
-type FileMetadata struct {
-	Filename string `json:"filename"`
-	LastModifiedDate time.Time `json:"last_modified_date"`
-	FileSizeGzipped int64 `json:"file_size_gzipped"`
-	Files []FileMetadata `json:"files"`
-}
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-type result struct {
-	result FileMetadata
-	error error
-}
+	"example/josh/goserver/metadata"
+)
 
-func gzippedSize(file *os.File) (int64, error) {
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	defer gz.Close()
+var addr = flag.String("addr", ":8080", "address to listen on, as host:port (env GMS_ADDR or ADDR)")
+var rootDir = flag.String("root", ".", "directory to serve metadata for; may be given as the only argument instead")
+var followSymlinks = flag.Bool("follow-symlinks", false, "walk through symlinks instead of reporting them as links")
+var oneFilesystem = flag.Bool("one-filesystem", false, "don't walk into directories on a different file system from the requested path, like find -xdev")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests when shutting down")
+var readTimeout = flag.Duration("read-timeout", 10*time.Second, "maximum time to read a request, including headers")
+var writeTimeout = flag.Duration("write-timeout", 5*time.Minute, "maximum time to walk a tree and write the response; large trees need a generous value")
+var idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "how long to keep an idle keep-alive connection open")
+var logFormat = flag.String("log-format", "text", "log output format: text or json")
+var tlsCert = flag.String("tls-cert", "", "PEM certificate file; serves HTTPS when set with -tls-key")
+var tlsKey = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+var socketPath = flag.String("socket", "", "listen on this Unix domain socket instead of -addr")
+var corsOrigin = flag.String("cors-origin", "", "origin allowed to make cross-origin requests, or * for any; disabled when empty")
+var cacheSize = flag.Int("cache-size", 10000, "number of files whose gzipped size is remembered between requests; 0 disables the cache")
+var gzipLevel = flag.String("gzip-level", "default", "compression level sizes are measured at: 1 to 9, default, best-speed or best-compression")
+var noGzip = flag.Bool("no-gzip", false, "list without compressed sizes, which is much faster, unless a request asks for ?gzip=true")
+var maxGzipBytes = flag.Int64("max-gzip-bytes", 0, "skip compressing files larger than this many bytes; 0 means no limit")
+var gzipTimeout = flag.Duration("gzip-timeout", 0, "skip compressing a file that takes longer than this, so one slow file can't stall a walk; 0 means no limit")
+var maxDepth = flag.Int("max-depth", metadata.DefaultMaxDepth, "deepest nesting walked below a requested path, whatever ?depth asks for; 0 means no limit")
+var ioRetries = flag.Int("io-retries", 2, "times to retry a file system call that fails with a transient error such as ESTALE, EAGAIN or EINTR")
+var ioRetryBackoff = flag.Duration("io-retry-backoff", 50*time.Millisecond, "wait before the first -io-retries retry, doubled for each one after")
+var maxEntries = flag.Int64("max-entries", 0, "answer 413 rather than list more entries than this in one response; 0 means no limit")
+var requestTimeout = flag.Duration("request-timeout", 0, "answer 503 when a walk takes longer than this; 0 disables the limit")
+var cacheMaxAge = flag.Duration("cache-max-age", 0, "let clients and CDNs reuse metadata responses for this long, revalidating with the ETag after; 0 sends no Cache-Control")
+var cachePublic = flag.Bool("cache-public", false, "mark responses under -cache-max-age public, so shared caches such as CDNs may store them, rather than private")
+var watch = flag.Bool("watch", false, "watch -root for changes and evict cached results as soon as files change")
+var authToken = flag.String("auth-token", "", "require this bearer token on every request but /healthz and /readyz; disabled when empty (env GMS_AUTH_TOKEN or AUTH_TOKEN)")
+var htpasswdFile = flag.String("htpasswd", "", "require HTTP Basic credentials from this bcrypt htpasswd file on every request but /healthz and /readyz; reread on SIGHUP or when it changes")
+var rateLimit = flag.Float64("rate", 0, "metadata requests allowed per second on average; 0 disables rate limiting")
+var rateBurst = flag.Int("burst", 0, "requests allowed at once above -rate; 0 means -rate rounded up")
+var ratePerClient = flag.Bool("rate-per-client", false, "apply -rate and -burst to each client IP separately rather than to all clients together")
+var maxConcurrency = flag.Int("max-concurrency", metadata.DefaultMaxConcurrency, "number of files read and compressed in parallel")
+var walkWorkers = flag.Int("walk-workers", 0, "most goroutines walking entries at once across all requests; 0 starts one per entry")
+var maxOpenFiles = flag.Int("max-open-files", defaultMaxOpenFiles(metadata.DefaultMaxConcurrency), "most file descriptors walks, downloads and archives may hold at once, whatever -max-concurrency says; the default is half the process's open file limit")
 
-	if _, err := io.Copy(gz, file); err != nil {
-		return 0, err
+// cacheControl is the Cache-Control sent with successful metadata
+// responses for -cache-max-age and -cache-public, or "" for none.
+func cacheControl(maxAge time.Duration, public bool) string {
+	if maxAge <= 0 {
+		return ""
 	}
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge/time.Second))
+}
 
-	if err := gz.Close(); err != nil {
-		return 0, err
+// parseAddr validates a host:port listen address.
+func parseAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("listen address is empty")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if port == "" {
+		return "", fmt.Errorf("invalid listen address %q: missing port", addr)
 	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return addr, nil
+}
 
-	return int64(buf.Len()), nil
+// newLogger builds the process logger in the requested format.
+func newLogger(format string, w io.Writer) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		return slog.New(requestIDHandler{slog.NewTextHandler(w, nil)}), nil
+	case "json":
+		return slog.New(requestIDHandler{slog.NewJSONHandler(w, nil)}), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q: must be text or json", format)
 }
 
-func filepathToJSONMetadata(path string, resultChan chan result) {
-	file, err := os.Open(path)
+// resolveRoot picks the directory to serve: -root, or a single positional
+// argument in its place. Giving both is an error, as is a root that isn't
+// an existing directory.
+func resolveRoot(flagRoot string, flagSet bool, args []string) (string, error) {
+	root := flagRoot
+	switch {
+	case len(args) > 1:
+		return "", fmt.Errorf("expected at most one root directory, got %d arguments", len(args))
+	case len(args) == 1 && flagSet && args[0] != flagRoot:
+		return "", fmt.Errorf("root given both as -root %q and as argument %q", flagRoot, args[0])
+	case len(args) == 1:
+		root = args[0]
+	}
+	fi, err := os.Stat(root)
 	if err != nil {
-		resultChan <- result{FileMetadata{}, err}
-		return
+		return "", fmt.Errorf("root: %w", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("root %q is not a directory", root)
 	}
-	defer file.Close()
+	return root, nil
+}
 
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		resultChan <- result{FileMetadata{}, err}
-		return
+// newHTTPServer applies the configured timeouts so slow or idle clients
+// cannot hold connections open indefinitely.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		Handler: handler,
+		ReadHeaderTimeout: *readTimeout,
+		ReadTimeout: *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout: *idleTimeout,
 	}
+}
 
-	if fileInfo.IsDir() {
-		files, err := os.ReadDir(path)
-		if err != nil {
-			resultChan <- result{FileMetadata{}, err}
-			return
+// validateTLS checks that the certificate and key are given together and
+// that both files can be read.
+func validateTLS(certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if f == "" {
+			continue
 		}
-
-		var wg = sync.WaitGroup{}
-		c := make(chan result, len(files))
-
-		for _, file := range files {
-			wg.Add(1)
-			go func(f os.DirEntry) {
-				defer wg.Done()
-				filepathToJSONMetadata(filepath.Join(path, file.Name()), c)
-			}(file)
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("TLS file: %w", err)
 		}
+	}
+	return nil
+}
 
-		go func() {
-			wg.Wait()
-			close(c)
-		}()
-
-		subfiles := make([]FileMetadata, 0, len(files))
-		for res := range c {
-			if res.error != nil {
-				resultChan <- result{FileMetadata{}, res.error}
-				return
-			}
-			subfiles = append(subfiles, res.result)
+// listenUnix listens on a Unix socket at path, replacing a stale socket
+// left behind by an earlier run. Anything other than a socket at path is
+// left alone.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
 		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serve runs srv, accepting connections with listen, until ctx is
+// cancelled, then gives in-flight requests up to drain to finish. Walks
+// still running after that are cancelled through their request contexts.
+func serve(ctx context.Context, srv *http.Server, listen func() error, drain time.Duration) error {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	errc := make(chan error, 1)
+	go func() { errc <- listen() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		cancelBase()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	log.Print("shutdown complete")
+	return nil
+}
 
-		resultChan <- result{
-			FileMetadata{
-				Filename: fileInfo.Name(),
-				LastModifiedDate: fileInfo.ModTime(),
-				FileSizeGzipped: 0,
-				Files: subfiles,
-			}, nil}
-		return
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	// A root argument overrides the environment and config file as -root
+	// would, so only the command line counts when checking for both.
+	rootSet := false
+	flag.Visit(func(f *flag.Flag) { rootSet = rootSet || f.Name == "root" })
+	if err := configure(flag.CommandLine, os.Getenv); err != nil {
+		log.Fatal(err)
 	}
 
-	gzippedSize, err := gzippedSize(file)
+	logger, err := newLogger(*logFormat, os.Stderr)
 	if err != nil {
-		resultChan <- result{FileMetadata{}, err}
-		return
+		log.Fatal(err)
 	}
+	// Route the standard log package through slog as well.
+	slog.SetDefault(logger)
 
-	resultChan <- result{
-		FileMetadata{
-			Filename: fileInfo.Name(),
-			LastModifiedDate: fileInfo.ModTime(),
-			FileSizeGzipped: gzippedSize,
-		}, nil}
-}
+	if *maxConcurrency < 1 {
+		log.Fatalf("-max-concurrency must be at least 1, got %d", *maxConcurrency)
+	}
+	if *rateLimit < 0 {
+		log.Fatalf("-rate must not be negative, got %g", *rateLimit)
+	}
+	if *rateBurst < 0 {
+		log.Fatalf("-burst must not be negative, got %d", *rateBurst)
+	}
+	if *walkWorkers < 0 {
+		log.Fatalf("-walk-workers must not be negative, got %d", *walkWorkers)
+	}
+	if *maxOpenFiles < 1 {
+		log.Fatalf("-max-open-files must be at least 1, got %d", *maxOpenFiles)
+	}
 
-func fileMetadataHandler(w http.ResponseWriter, r *http.Request) {
-	dir, err := os.Getwd()
+	if *cacheSize < 0 {
+		log.Fatalf("-cache-size must not be negative, got %d", *cacheSize)
+	}
+	if *maxGzipBytes < 0 {
+		log.Fatalf("-max-gzip-bytes must not be negative, got %d", *maxGzipBytes)
+	}
+	if *gzipTimeout < 0 {
+		log.Fatalf("-gzip-timeout must not be negative, got %s", *gzipTimeout)
+	}
+	if *maxDepth < 0 {
+		log.Fatalf("-max-depth must not be negative, got %d", *maxDepth)
+	}
+	if *maxEntries < 0 {
+		log.Fatalf("-max-entries must not be negative, got %d", *maxEntries)
+	}
+	if *ioRetries < 0 {
+		log.Fatalf("-io-retries must not be negative, got %d", *ioRetries)
+	}
+	if *ioRetryBackoff < 0 {
+		log.Fatalf("-io-retry-backoff must not be negative, got %s", *ioRetryBackoff)
+	}
+	if *cacheMaxAge != 0 && *cacheMaxAge < time.Second {
+		log.Fatalf("-cache-max-age must be 0 or at least 1s, got %s", *cacheMaxAge)
+	}
+	if *cachePublic && *cacheMaxAge == 0 {
+		log.Fatal("-cache-public has nothing to do without -cache-max-age")
+	}
+	if *watch && *cacheSize == 0 {
+		log.Fatal("-watch has nothing to do with -cache-size 0")
+	}
+
+	level, err := parseGzipLevel(*gzipLevel)
 	if err != nil {
-		http.Error(w, "Error getting working directory", http.StatusInternalServerError)
-		return
+		log.Fatal(err)
 	}
 
-	path := filepath.Join(dir, r.URL.Path)
+	root := *rootDir
+	if flag.Arg(0) != "walk" {
+		root, err = resolveRoot(*rootDir, rootSet, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		log.Fatalf("resolving root %q: %v", root, err)
+	}
 
-	c := make(chan result, 1)
-	go filepathToJSONMetadata(path, c)
-	res := <-c
+	// Walks, downloads and archives all open files through fsys, so this
+	// one Limiter bounds the descriptors the server holds for them.
+	openFiles := metadata.NewLimiter(*maxOpenFiles)
+	s := &server{
+		root: root,
+		fsys: metadata.LimitOpenFiles(os.DirFS(root), openFiles),
+		openFiles: openFiles,
+		limiter: metadata.NewLimiter(*maxConcurrency),
+		gzipLevel: level,
+		noGzip: *noGzip,
+		maxCompressBytes: *maxGzipBytes,
+		compressTimeout: *gzipTimeout,
+		maxDepth: *maxDepth,
+		maxEntries: *maxEntries,
+		ioRetries: *ioRetries,
+		ioRetryBackoff: *ioRetryBackoff,
+		requestTimeout: *requestTimeout,
+		followSymlinks: *followSymlinks,
+		oneFilesystem: *oneFilesystem,
+	}
+	s.cacheControl = cacheControl(*cacheMaxAge, *cachePublic)
+	if *walkWorkers > 0 {
+		s.workers = metadata.NewLimiter(*walkWorkers)
+	}
+	if *cacheSize > 0 {
+		s.cache = metadata.NewCache(*cacheSize)
+	}
+	if flag.Arg(0) == "walk" {
+		os.Exit(runWalk(s, flag.Args()[1:]))
+	}
 
-	if err := res.error; err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
+	listenAddr := *addr
+	if *socketPath == "" {
+		listenAddr, err = parseAddr(*addr)
+		if err != nil {
+			log.Fatal(err)
 		}
-		fmt.Println(res.error)
-		http.Error(w, "Error reading file ", http.StatusInternalServerError)
 	}
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(res.result); err != nil {
-		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+	if err := validateTLS(*tlsCert, *tlsKey); err != nil {
+		log.Fatal(err)
+	}
+	if *authToken != "" && *htpasswdFile != "" {
+		log.Fatal("-auth-token and -htpasswd can't be used together")
+	}
+	var users *htpasswd
+	if *htpasswdFile != "" {
+		users, err = loadHtpasswd(*htpasswdFile)
+		if err != nil {
+			log.Fatalf("reading -htpasswd: %v", err)
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-}
+	// Probes can't be expected to authenticate, so /healthz and /readyz
+	// stay open, along with the API description.
+	authenticate := func(h http.Handler) http.Handler {
+		if *authToken != "" {
+			return bearerAuthMiddleware(*authToken, h)
+		}
+		if users != nil {
+			return basicAuthMiddleware(logger, users, h)
+		}
+		return h
+	}
+	// Only routes that read the tree are rate limited, sharing one set of
+	// buckets; health checks and scrapes are cheap and must keep
+	// answering under load.
+	var limiter *rateLimiter
+	if *rateLimit > 0 {
+		limiter = newRateLimiter(*rateLimit, *rateBurst, *ratePerClient)
+	}
+	readsTree := func(h http.Handler) http.Handler {
+		if limiter != nil {
+			h = rateLimitMiddleware(limiter, h)
+		}
+		return authenticate(h)
+	}
 
-func main() {
-	http.HandleFunc("/", fileMetadataHandler)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// The /healthz, /readyz, /openapi.json, /metrics, /version, /download/
+	// and /archive/ patterns take precedence over the catch-all, so files
+	// with those names at the top of the root are shadowed.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.Handle("/metrics", authenticate(promhttp.Handler()))
+	mux.Handle("/version", authenticate(http.HandlerFunc(versionHandler)))
+	mux.Handle("/download/", readsTree(http.HandlerFunc(s.downloadHandler)))
+	mux.Handle("/archive/", readsTree(http.HandlerFunc(s.archiveHandler)))
+	mux.Handle("/", readsTree(gzipMiddleware(http.HandlerFunc(s.fileMetadataHandler))))
+
+	var handler http.Handler = mux
+	handler = recoverMiddleware(logger, handler)
+	if *corsOrigin != "" {
+		handler = corsMiddleware(*corsOrigin, handler)
+	}
+	handler = metricsMiddleware(handler)
+	handler = loggingMiddleware(logger, handler)
+	handler = requestIDMiddleware(handler)
+	srv := newHTTPServer(listenAddr, handler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if users != nil {
+		users.reloadOnHangup(ctx, logger)
+	}
+	if *watch {
+		if err := watchRoot(ctx, logger, root, s.cache); err != nil {
+			log.Fatalf("watching -root: %v", err)
+		}
+	}
+	listen := srv.ListenAndServe
+	if *tlsCert != "" {
+		listen = func() error { return srv.ListenAndServeTLS(*tlsCert, *tlsKey) }
+	}
+	if *socketPath != "" {
+		ln, err := listenUnix(*socketPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Closing the listener during shutdown unlinks the socket; the
+		// explicit Remove covers exits that skip it.
+		defer os.Remove(*socketPath)
+		listen = func() error { return srv.Serve(ln) }
+		if *tlsCert != "" {
+			listen = func() error { return srv.ServeTLS(ln, *tlsCert, *tlsKey) }
+		}
+	}
+	if err := serve(ctx, srv, listen, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
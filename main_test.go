@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example/josh/goserver/metadata"
+)
+
+func TestParseAddr(t *testing.T) {
+	valid := []string{":8080", "127.0.0.1:9000", "localhost:0", "[::1]:8080", "0.0.0.0:65535"}
+	for _, addr := range valid {
+		got, err := parseAddr(addr)
+		if err != nil || got != addr {
+			t.Errorf("parseAddr(%q) = %q, %v; want it unchanged", addr, got, err)
+		}
+	}
+	invalid := []string{"", "8080", "localhost", ":", "localhost:", "host:port:extra", ":99999", ":-1", "[::1:8080"}
+	for _, addr := range invalid {
+		if _, err := parseAddr(addr); err == nil {
+			t.Errorf("parseAddr(%q) succeeded, want an error", addr)
+		}
+	}
+}
+
+func TestResolveRoot(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	file := filepath.Join(dir, "f")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flagRoot string
+		flagSet bool
+		args []string
+		want string
+		ok bool
+	}{
+		{".", false, nil, ".", true},
+		{dir, true, nil, dir, true},
+		{".", false, []string{dir}, dir, true},
+		// The same directory both ways is not a conflict.
+		{dir, true, []string{dir}, dir, true},
+		{dir, true, []string{other}, "", false},
+		{".", false, []string{dir, other}, "", false},
+		{filepath.Join(dir, "missing"), true, nil, "", false},
+		{file, true, nil, "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveRoot(tt.flagRoot, tt.flagSet, tt.args)
+		if tt.ok != (err == nil) || got != tt.want {
+			t.Errorf("resolveRoot(%q, %t, %q) = %q, %v; want %q, ok %t", tt.flagRoot, tt.flagSet, tt.args, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestResolveRootErrors(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	file := filepath.Join(dir, "f")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Each error names what was wrong, so a mistyped command line is
+	// easy to fix.
+	for _, tt := range []struct {
+		flagRoot string
+		flagSet bool
+		args []string
+		want string
+	}{
+		{dir, true, []string{other}, "both as -root"},
+		{".", false, []string{dir, other}, "at most one"},
+		{".", false, []string{filepath.Join(dir, "missing")}, "no such file"},
+		{".", false, []string{file}, "not a directory"},
+	} {
+		_, err := resolveRoot(tt.flagRoot, tt.flagSet, tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("resolveRoot(%q, %t, %q) error %v, want one mentioning %q", tt.flagRoot, tt.flagSet, tt.args, err, tt.want)
+		}
+	}
+}
+
+// startServe runs serve for handler on an ephemeral port until the
+// returned cancel is called, sending its result on the returned channel.
+func startServe(t *testing.T, handler http.Handler, drain time.Duration) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, func() error { return srv.Serve(ln) }, drain) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	url, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "finished")
+	}), 5*time.Second)
+
+	type reply struct {
+		body string
+		err error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			replies <- reply{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		replies <- reply{string(body), err}
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		t.Fatalf("serve returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("a new connection was accepted after shutdown began")
+	}
+	close(release)
+	if r := <-replies; r.err != nil || r.body != "finished" {
+		t.Errorf("in-flight request got %q, %v; want it to finish", r.body, r.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serve = %v, want nil after a clean shutdown", err)
+	}
+}
+
+func TestServeCancelsRequestsAfterDrain(t *testing.T) {
+	cancelled := make(chan struct{})
+	started := make(chan struct{})
+	url, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	}), 20*time.Millisecond)
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("serve = nil, want the drain timeout reported")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request's context was not cancelled after the drain timeout")
+	}
+}
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	defer func(r, w, i time.Duration) { *readTimeout, *writeTimeout, *idleTimeout = r, w, i }(*readTimeout, *writeTimeout, *idleTimeout)
+	*readTimeout, *writeTimeout, *idleTimeout = 3*time.Second, 7*time.Minute, 90*time.Second
+
+	h := http.NotFoundHandler()
+	srv := newHTTPServer(":9999", h)
+	if srv.Addr != ":9999" || srv.Handler == nil {
+		t.Errorf("server for %q with handler %v, want :9999 and the handler", srv.Addr, srv.Handler)
+	}
+	if srv.ReadTimeout != 3*time.Second || srv.ReadHeaderTimeout != 3*time.Second {
+		t.Errorf("ReadTimeout %s, ReadHeaderTimeout %s; want 3s", srv.ReadTimeout, srv.ReadHeaderTimeout)
+	}
+	if srv.WriteTimeout != 7*time.Minute {
+		t.Errorf("WriteTimeout %s, want 7m", srv.WriteTimeout)
+	}
+	if srv.IdleTimeout != 90*time.Second {
+		t.Errorf("IdleTimeout %s, want 1m30s", srv.IdleTimeout)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to
+// PEM files in a temporary directory.
+func writeCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestValidateTLS(t *testing.T) {
+	certFile, keyFile, _ := writeCert(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []struct {
+		cert, key string
+		ok bool
+	}{
+		{"", "", true},
+		{certFile, keyFile, true},
+		{certFile, "", false},
+		{"", keyFile, false},
+		{missing, keyFile, false},
+		{certFile, missing, false},
+	}
+	for _, tt := range tests {
+		if err := validateTLS(tt.cert, tt.key); (err == nil) != tt.ok {
+			t.Errorf("validateTLS(%q, %q) = %v, want ok %t", tt.cert, tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Error("request arrived without TLS")
+		}
+		io.WriteString(w, "secure")
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, func() error { return srv.ServeTLS(ln, certFile, keyFile) }, time.Second) }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "secure" {
+		t.Errorf("got %q, %v over HTTPS", body, err)
+	}
+	if resp, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("plain HTTP got %d, want the 400 a TLS server sends", resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+	client.CloseIdleConnections()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("serve = %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	// Socket paths are limited to about a hundred bytes, which a test's
+	// TempDir can exceed.
+	dir, err := os.MkdirTemp("", "gms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "gms.sock")
+
+	// A socket left behind by a run that didn't clean up is replaced.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(sock)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "aaa", "d/b.txt": "b"})
+	s := newTestServer(t, root)
+	srv := &http.Server{Handler: http.HandlerFunc(s.fileMetadataHandler)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, func() error { return srv.Serve(ln) }, time.Second) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://gms/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md metadata.FileMetadata
+	err = json.NewDecoder(resp.Body).Decode(&md)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || md.FileCount != 2 || md.FileSize != 4 {
+		t.Errorf("over the socket: %d, %d files of %d bytes, %v; want 200 with 2 files of 4", resp.StatusCode, md.FileCount, md.FileSize, err)
+	}
+	client.CloseIdleConnections()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("serve = %v", err)
+	}
+	if _, err := os.Lstat(sock); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket still there after shutdown: %v", err)
+	}
+
+	// Anything else at the path is left alone.
+	if err := os.WriteFile(sock, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listenUnix(sock); err == nil {
+		ln.Close()
+		t.Error("listenUnix replaced a regular file")
+	}
+	if data, _ := os.ReadFile(sock); string(data) != "keep" {
+		t.Errorf("regular file now holds %q", data)
+	}
+}
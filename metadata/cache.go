@@ -0,0 +1,126 @@
+package metadata
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache remembers what was computed for each file so unchanged files are
+// not read and compressed again on the next walk. An entry is used only
+// while the file's mtime and size are the ones it was computed for. A
+// Cache is safe for concurrent use and may be shared between walks of the
+// same file system.
+type Cache struct {
+	mu sync.Mutex
+	max int
+	entries map[string]*list.Element
+	// lru holds *cacheEntry values, most recently used at the front.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	name string
+	modTime time.Time
+	size int64
+	// checksumAlgo is the Checksum option the entry was computed with.
+	checksumAlgo string
+	compression string
+	gzipLevel int
+	compressed int64
+	mimeType string
+	checksum string
+}
+
+// NewCache returns a Cache holding at most maxEntries files, dropping the
+// least recently used beyond that.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		max: maxEntries,
+		entries: make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+// get returns the entry for name if it is still valid for a file with the
+// given mtime and size, walked with opts.
+func (c *Cache) get(name string, modTime time.Time, size int64, opts Options) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.modTime.Equal(modTime) || e.size != size || e.checksumAlgo != opts.Checksum ||
+		e.compression != opts.compression() || e.gzipLevel != opts.gzipLevel() {
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	return *e, true
+}
+
+// put records e, replacing any older entry for the same file.
+func (c *Cache) put(e cacheEntry) {
+	if c == nil || c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.name]; ok {
+		*el.Value.(*cacheEntry) = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.name] = c.lru.PushFront(&e)
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Evict drops the entry for name and for anything beneath it, for callers
+// that learn of a change before the mtime would reveal it.
+func (c *Cache) Evict(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	for entryName, el := range c.entries {
+		if strings.HasPrefix(entryName, prefix) {
+			c.remove(el)
+		}
+	}
+}
+
+// EvictFile drops the entry for name alone. Unlike Evict it doesn't look
+// through the whole cache for entries beneath name, so it is the one to
+// use for a change that can only touch the one file.
+func (c *Cache) EvictFile(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+}
+
+// Clear drops every entry.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.lru.Init()
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).name)
+}
@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opens counts the files a walk opened, leaving directory listings out.
+func opens(f *faultyFS) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for call, calls := range f.calls {
+		if strings.HasPrefix(call, "open ") {
+			n += calls
+		}
+	}
+	clear(f.calls)
+	return n
+}
+
+func TestCacheSkipsUnchangedFiles(t *testing.T) {
+	tree := wideTree(3, 10)
+	fsys := &faultyFS{fsys: tree}
+	opts := DefaultOptions()
+	opts.Cache = NewCache(100)
+
+	first := walk(t, fsys, ".", opts)
+	if n := opens(fsys); n < 30 {
+		t.Fatalf("first walk opened %d files, want all 30", n)
+	}
+	second := walk(t, fsys, ".", opts)
+	if n := opens(fsys); n != 0 {
+		t.Errorf("second walk of an unchanged tree opened %d files, want none", n)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("the cached walk differs from the first")
+	}
+
+	// Touching a file or changing its size invalidates only its entry.
+	tree["d000/f000.txt"].ModTime = modTime.Add(time.Hour)
+	tree["d001/f001.txt"].Data = []byte(strings.Repeat("z", 1000))
+	third := walk(t, fsys, ".", opts)
+	if n := opens(fsys); n != 2 {
+		t.Errorf("after changing two files the walk opened %d, want 2", n)
+	}
+	if f := find(&third, "d001/f001.txt"); f.FileSize != 1000 || *f.FileSizeGzipped >= 1000 {
+		t.Errorf("changed file reports %d bytes, %d gzipped", f.FileSize, *f.FileSizeGzipped)
+	}
+
+	// Sizes measured another way aren't reused.
+	opts.GzipLevel = gzip.BestSpeed
+	walk(t, fsys, ".", opts)
+	if n := opens(fsys); n < 30 {
+		t.Errorf("walk at another gzip level opened %d files, want all 30", n)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(2)
+	opts := DefaultOptions()
+	for _, name := range []string{"a", "b", "c"} {
+		c.put(cacheEntry{name: name, modTime: modTime, size: 1, compression: opts.compression(), gzipLevel: opts.gzipLevel()})
+		if name == "b" {
+			// Using a makes b the oldest.
+			if _, ok := c.get("a", modTime, 1, opts); !ok {
+				t.Fatal("a missing")
+			}
+		}
+	}
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(name, modTime, 1, opts); ok != want {
+			t.Errorf("%s cached %t, want %t", name, ok, want)
+		}
+	}
+	if _, ok := c.get("a", modTime.Add(time.Second), 1, opts); ok {
+		t.Error("entry used for a file with another mtime")
+	}
+	if _, ok := c.get("a", modTime, 2, opts); ok {
+		t.Error("entry used for a file with another size")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c := NewCache(10)
+	opts := DefaultOptions()
+	for _, name := range []string{"d/a", "d/sub/b", "dx/c", "e"} {
+		c.put(cacheEntry{name: name, modTime: modTime, size: 1, compression: opts.compression(), gzipLevel: opts.gzipLevel()})
+	}
+	c.Evict("d")
+	for name, want := range map[string]bool{"d/a": false, "d/sub/b": false, "dx/c": true, "e": true} {
+		if _, ok := c.get(name, modTime, 1, opts); ok != want {
+			t.Errorf("after Evict(d), %s cached %t, want %t", name, ok, want)
+		}
+	}
+	c.EvictFile("dx")
+	if _, ok := c.get("dx/c", modTime, 1, opts); !ok {
+		t.Error("EvictFile(dx) dropped dx/c beneath it")
+	}
+	c.EvictFile("dx/c")
+	if _, ok := c.get("dx/c", modTime, 1, opts); ok {
+		t.Error("EvictFile(dx/c) left it cached")
+	}
+	c.Evict(".")
+	if _, ok := c.get("e", modTime, 1, opts); ok {
+		t.Error("Evict(.) left e cached")
+	}
+}
@@ -0,0 +1,30 @@
+package metadata_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"testing/fstest"
+
+	"example/josh/goserver/metadata"
+)
+
+func ExampleWalk() {
+	fsys := fstest.MapFS{
+		"docs/readme.md": {Data: []byte("# hello\n")},
+		"docs/notes.txt": {Data: []byte("notes\n")},
+		"main.go": {Data: []byte("package main\n")},
+	}
+	md, err := metadata.Walk(context.Background(), fsys, ".", metadata.DefaultOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d files, %d bytes\n", md.FileCount, md.FileSize)
+	for _, f := range md.Files {
+		fmt.Println(f.Path, f.Type, f.FileSize)
+	}
+	// Output:
+	// 3 files, 27 bytes
+	// docs directory 14
+	// main.go file 13
+}
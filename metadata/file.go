@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// countingWriter discards everything written to it, keeping only the count.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// newCompressor returns a writer that compresses into w with algo.
+// gzipLevel only applies to gzip; the others use their default levels.
+func newCompressor(w io.Writer, algo string, gzipLevel int) (io.WriteCloser, error) {
+	switch algo {
+	case "", "gzip":
+		return gzip.NewWriterLevel(w, gzipLevel)
+	case "brotli":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("invalid compression %q: must be one of gzip, brotli, zstd", algo)
+}
+
+// contextReader fails once its context is done. A read already blocked
+// in the kernel still runs to completion, but nothing more is read after.
+type contextReader struct {
+	ctx context.Context
+	r io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// compressedSize reports how many bytes file compresses to with algo.
+func compressedSize(file io.Reader, algo string, gzipLevel int) (int64, error) {
+	var cw countingWriter
+	zw, err := newCompressor(&cw, algo, gzipLevel)
+	if err != nil {
+		return 0, err
+	}
+	defer zw.Close()
+
+	// The zstd encoder frames what it reads itself differently from what
+	// is written to it, so hide its ReadFrom to get the same size whatever
+	// kind of reader file is.
+	if _, err := io.Copy(struct{ io.Writer }{zw}, file); err != nil {
+		return 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	return cw.n, nil
+}
+
+// newChecksum returns a fresh hash for one of the supported checksum
+// algorithms.
+func newChecksum(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("invalid checksum %q: must be one of sha256, md5, crc32", algo)
+}
+
+// directoryMimeType is reported for directories, following the shared-mime-info
+// convention.
+const directoryMimeType = "inode/directory"
+
+// specialMimeType names a device, pipe or socket the same way, without
+// opening it. It returns "" for anything else.
+func specialMimeType(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeCharDevice != 0:
+		return "inode/chardevice"
+	case mode&fs.ModeDevice != 0:
+		return "inode/blockdevice"
+	case mode&fs.ModeNamedPipe != 0:
+		return "inode/fifo"
+	case mode&fs.ModeSocket != 0:
+		return "inode/socket"
+	}
+	return ""
+}
+
+// detectMimeType guesses a file's type from its extension, falling back to
+// sniffing the first 512 bytes. The returned reader yields the whole file,
+// including any bytes consumed while sniffing.
+func detectMimeType(name string, file io.Reader) (string, io.Reader, error) {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t, file, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), file), nil
+}
@@ -0,0 +1,302 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// bufferedSize measures compressed size the way gzipFile once did, by
+// compressing into a buffer and taking its length.
+func bufferedSize(data []byte, algo string, level int) (int64, error) {
+	var buf bytes.Buffer
+	zw, err := newCompressor(&buf, algo, level)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(zw, bytes.NewReader(data)); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), nil
+}
+
+// testInputs are compressible, incompressible and empty contents.
+func testInputs() map[string][]byte {
+	random := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty": nil,
+		"text": []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000)),
+		"random": random,
+	}
+}
+
+func TestCompressedSizeMatchesBuffered(t *testing.T) {
+	cases := []struct {
+		algo string
+		level int
+	}{
+		{"gzip", gzip.DefaultCompression},
+		{"gzip", gzip.BestSpeed},
+		{"gzip", gzip.BestCompression},
+		{"brotli", 0},
+		{"zstd", 0},
+	}
+	for name, data := range testInputs() {
+		for _, c := range cases {
+			want, err := bufferedSize(data, c.algo, c.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := compressedSize(bytes.NewReader(data), c.algo, c.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s with %s at %d: compressedSize = %d, buffered size = %d", name, c.algo, c.level, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkCompressedSize compares counting the compressed bytes with
+// buffering them, on 16 MiB that barely compresses.
+func BenchmarkCompressedSize(b *testing.B) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	b.Run("counting", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := compressedSize(bytes.NewReader(data), "gzip", gzip.DefaultCompression); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := bufferedSize(data, "gzip", gzip.DefaultCompression); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestWalkCompressionAlgorithms(t *testing.T) {
+	inputs := testInputs()
+	fsys := fstest.MapFS{
+		"text": file(string(inputs["text"])),
+		"random": file(string(inputs["random"])),
+	}
+	sizes := map[string]int64{}
+	for _, algo := range []string{"gzip", "brotli", "zstd"} {
+		opts := DefaultOptions()
+		opts.Compression = algo
+		md := walk(t, fsys, ".", opts)
+		for _, name := range []string{"text", "random"} {
+			f := find(&md, name)
+			if f.CompressionAlgo != algo {
+				t.Errorf("%s with %s: compression_algo %q", name, algo, f.CompressionAlgo)
+			}
+			want, err := bufferedSize(inputs[name], algo, gzip.DefaultCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.CompressedSize != want {
+				t.Errorf("%s with %s: compressed_size %d, want %d", name, algo, f.CompressedSize, want)
+			}
+			// Only gzip fills in the gzip size.
+			if (f.FileSizeGzipped != nil) != (algo == "gzip") {
+				t.Errorf("%s with %s: file_size_gzipped %v", name, algo, f.FileSizeGzipped)
+			}
+		}
+		text, random := find(&md, "text").CompressedSize, find(&md, "random").CompressedSize
+		if text*10 > int64(len(inputs["text"])) || random < int64(len(inputs["random"])) {
+			t.Errorf("%s: text down to %d bytes and random to %d, want text far smaller and random no smaller", algo, text, random)
+		}
+		if md.CompressedSize != text+random || md.CompressionAlgo != algo {
+			t.Errorf("%s: directory totals %d under %q, want %d", algo, md.CompressedSize, md.CompressionAlgo, text+random)
+		}
+		sizes[algo] = text
+	}
+	if sizes["gzip"] == sizes["brotli"] || sizes["gzip"] == sizes["zstd"] || sizes["brotli"] == sizes["zstd"] {
+		t.Errorf("text compressed to the same size under two algorithms: %v", sizes)
+	}
+
+	opts := DefaultOptions()
+	opts.Compression = "lzma"
+	if _, err := Walk(context.Background(), fsys, ".", opts); err == nil {
+		t.Error("Walk accepted compression lzma")
+	}
+}
+
+// readCounter counts the bytes read from files opened through fsys.
+type readCounter struct {
+	fstest.MapFS
+	n atomic.Int64
+}
+
+func (c *readCounter) Open(name string) (fs.File, error) {
+	f, err := c.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countedReads{f, &c.n}, nil
+}
+
+type countedReads struct {
+	fs.File
+	n *atomic.Int64
+}
+
+func (c countedReads) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestWalkSkipsCompressingLargeFiles(t *testing.T) {
+	const limit = 1 << 20
+	fsys := &readCounter{MapFS: fstest.MapFS{
+		"big.txt": file(strings.Repeat("big ", 1<<20)),
+		"small.txt": file(strings.Repeat("small ", 1000)),
+	}}
+	opts := DefaultOptions()
+	opts.MaxCompressBytes = limit
+	md := walk(t, fsys, ".", opts)
+
+	big := find(&md, "big.txt")
+	if !big.CompressionSkipped || big.CompressedSize != 0 || big.FileSizeGzipped != nil || big.CompressionRatio != 0 {
+		t.Errorf("big.txt: skipped %t, compressed to %d, gzipped %v, ratio %g; want skipped with no sizes", big.CompressionSkipped, big.CompressedSize, big.FileSizeGzipped, big.CompressionRatio)
+	}
+	if big.FileSize != 4<<20 || big.MimeType == "" {
+		t.Errorf("big.txt: %d bytes of %q, want its size and type still reported", big.FileSize, big.MimeType)
+	}
+	small := find(&md, "small.txt")
+	if small.CompressionSkipped || small.CompressedSize == 0 {
+		t.Errorf("small.txt under the limit: skipped %t, compressed to %d", small.CompressionSkipped, small.CompressedSize)
+	}
+	// Only enough of the big file to sniff its type is read.
+	if n := fsys.n.Load(); n > 6000+4096 {
+		t.Errorf("read %d bytes, want little more than small.txt's 6000", n)
+	}
+	if !md.CompressionSkipped || md.CompressedSize != small.CompressedSize {
+		t.Errorf("root: skipped %t, compressed %d; want skipped, with only small.txt's %d", md.CompressionSkipped, md.CompressedSize, small.CompressedSize)
+	}
+}
+
+// slowReads makes every read of the files named in slow take delay.
+type slowReads struct {
+	fstest.MapFS
+	slow map[string]bool
+	delay time.Duration
+}
+
+func (s slowReads) Open(name string) (fs.File, error) {
+	f, err := s.MapFS.Open(name)
+	if err != nil || !s.slow[name] {
+		return f, err
+	}
+	return slowFile{f, s.delay}, nil
+}
+
+type slowFile struct {
+	fs.File
+	delay time.Duration
+}
+
+func (f slowFile) Read(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.Read(p)
+}
+
+func TestWalkCompressTimeout(t *testing.T) {
+	data := strings.Repeat("slow and steady\n", 20000)
+	fsys := slowReads{
+		MapFS: fstest.MapFS{"slow.txt": file(data), "d/fast.txt": file(data)},
+		slow: map[string]bool{"slow.txt": true},
+		delay: 100 * time.Millisecond,
+	}
+	opts := DefaultOptions()
+	opts.CompressTimeout = 150 * time.Millisecond
+	opts.Checksum = "sha256"
+	opts.Cache = NewCache(10)
+	start := time.Now()
+	md := walk(t, fsys, ".", opts)
+	// Reading all of slow.txt, 32 KiB at a time, would take over a second.
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("walk took %s, want it cut short after the timeout", elapsed)
+	}
+
+	slow := find(&md, "slow.txt")
+	if !slow.CompressionSkipped || slow.CompressedSize != 0 || slow.FileSizeGzipped != nil || slow.Checksum != "" || slow.Error != "" {
+		t.Errorf("slow.txt: skipped %t, compressed to %d, checksum %q, error %q; want skipped without sizes, checksum or error", slow.CompressionSkipped, slow.CompressedSize, slow.Checksum, slow.Error)
+	}
+	if slow.FileSize != int64(len(data)) {
+		t.Errorf("slow.txt: %d bytes, want its size still reported", slow.FileSize)
+	}
+	// The walk carries on with the other files.
+	fast := find(&md, "d/fast.txt")
+	if fast.CompressionSkipped || fast.CompressedSize == 0 || fast.Checksum == "" {
+		t.Errorf("d/fast.txt: skipped %t, compressed to %d, checksum %q; want it measured", fast.CompressionSkipped, fast.CompressedSize, fast.Checksum)
+	}
+	if !md.CompressionSkipped || md.CompressedSize != fast.CompressedSize {
+		t.Errorf("root: skipped %t, compressed %d; want skipped, with only fast.txt's %d", md.CompressionSkipped, md.CompressedSize, fast.CompressedSize)
+	}
+
+	// A skipped file isn't cached, so with time enough it is measured.
+	opts.CompressTimeout = 0
+	fsys.delay = time.Millisecond
+	md = walk(t, fsys, ".", opts)
+	if slow := find(&md, "slow.txt"); slow.CompressionSkipped || slow.CompressedSize != fast.CompressedSize {
+		t.Errorf("slow.txt without a timeout: skipped %t, compressed to %d, want %d", slow.CompressionSkipped, slow.CompressedSize, fast.CompressedSize)
+	}
+}
+
+func TestWalkCompressionRatio(t *testing.T) {
+	inputs := testInputs()
+	fsys := fstest.MapFS{
+		"text": file(string(inputs["text"])),
+		"random": file(string(inputs["random"])),
+		"empty": file(""),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+	text, random := find(&md, "text"), find(&md, "random")
+	if text.CompressionRatio <= 0 || text.CompressionRatio > 0.05 {
+		t.Errorf("text ratio %g, want a small fraction", text.CompressionRatio)
+	}
+	if random.CompressionRatio < 1 || random.CompressionRatio > 1.01 {
+		t.Errorf("random ratio %g, want just over 1", random.CompressionRatio)
+	}
+	for _, f := range []*FileMetadata{text, random} {
+		if want := float64(*f.FileSizeGzipped) / float64(f.FileSize); f.CompressionRatio != want {
+			t.Errorf("%s ratio %g, want gzipped over raw, %g", f.Path, f.CompressionRatio, want)
+		}
+	}
+	// An empty file has no ratio rather than a division by zero.
+	if empty := find(&md, "empty"); empty.CompressionRatio != 0 {
+		t.Errorf("empty file ratio %g, want 0", empty.CompressionRatio)
+	}
+	if want := float64(*md.FileSizeGzipped) / float64(md.FileSize); md.CompressionRatio != want {
+		t.Errorf("directory ratio %g, want its totals' %g", md.CompressionRatio, want)
+	}
+
+	opts := DefaultOptions()
+	opts.SkipGzip = true
+	if md := walk(t, fsys, ".", opts); md.CompressionRatio != 0 || find(&md, "text").CompressionRatio != 0 {
+		t.Errorf("ratios %g and %g without compression, want none", md.CompressionRatio, find(&md, "text").CompressionRatio)
+	}
+}
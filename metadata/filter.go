@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// matchGlob reports whether name matches pattern. A pattern containing a
+// slash is matched against the whole path; any other pattern is matched
+// against the last element, so "*.go" finds Go files at every level.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePatterns reports the first malformed glob in patterns.
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// skip reports whether the directory entry name should be left out of the
+// walk. Skipped directories are not descended into; Include never hides
+// a directory, since the files it is looking for may be anywhere below.
+func (o Options) skip(name string, isDir bool) bool {
+	if o.SkipHidden && strings.HasPrefix(path.Base(name), ".") {
+		return true
+	}
+	if matchAny(o.Exclude, name) {
+		return true
+	}
+	return !isDir && len(o.Include) > 0 && !matchAny(o.Include, name)
+}
+
+// filtersFiles reports whether only some regular files are kept, in which
+// case directories left with none of them are dropped as well.
+func (o Options) filtersFiles() bool {
+	return o.MinSize > 0 || o.MaxSize > 0 || !o.ModifiedAfter.IsZero() || !o.ModifiedBefore.IsZero() || o.Regexp != nil
+}
+
+// keepFile reports whether the regular file m passes the file filters.
+func (o Options) keepFile(m FileMetadata) bool {
+	if o.MinSize > 0 && m.FileSize < o.MinSize {
+		return false
+	}
+	if o.MaxSize > 0 && m.FileSize > o.MaxSize {
+		return false
+	}
+	if !o.ModifiedAfter.IsZero() && !m.LastModifiedDate.After(o.ModifiedAfter) {
+		return false
+	}
+	if !o.ModifiedBefore.IsZero() && !m.LastModifiedDate.Before(o.ModifiedBefore) {
+		return false
+	}
+	if o.Regexp != nil && !o.Regexp.MatchString(m.Path) {
+		return false
+	}
+	return true
+}
+
+// filteredOut reports whether a finished entry should be dropped by the
+// file filters. Errors and directories that weren't walked are kept, since
+// whether they hold a match is unknown, and so is the walked path itself.
+func (o walkOptions) filteredOut(m FileMetadata) bool {
+	if !o.filtersFiles() || o.level == 0 || m.Error != "" {
+		return false
+	}
+	switch {
+	case m.regular:
+		return !o.keepFile(m)
+	case m.Type == "directory":
+		return !m.Truncated && m.FileCount == 0
+	}
+	// Links and special files have no contents to match.
+	return true
+}
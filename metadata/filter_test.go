@@ -0,0 +1,106 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// repoTree is a checkout with Go and JavaScript sources and vendored
+// modules.
+func repoTree() fstest.MapFS {
+	return fstest.MapFS{
+		"main.go": file("package main"),
+		"main_test.go": file("package main"),
+		"README.md": file("readme"),
+		"web/app.js": file("app"),
+		"web/style.css": file("css"),
+		"web/node_modules/lib/index.js": file("lib"),
+		"web/node_modules/lib/lib.go": file("package lib"),
+		"internal/x/x.go": file("package x"),
+		"internal/x/x.js": file("x"),
+	}
+}
+
+// files lists the paths of the regular files in md, in walk order.
+func files(md FileMetadata) []string {
+	var out []string
+	if md.Type == "file" {
+		out = append(out, md.Path)
+	}
+	for _, f := range md.Files {
+		out = append(out, files(f)...)
+	}
+	return out
+}
+
+func TestWalkFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		include, exclude []string
+		want []string
+	}{
+		{"include *.go", []string{"*.go"}, nil, []string{"internal/x/x.go", "main.go", "main_test.go", "web/node_modules/lib/lib.go"}},
+		{"include several", []string{"*.js", "README.md"}, nil, []string{"README.md", "internal/x/x.js", "web/app.js", "web/node_modules/lib/index.js"}},
+		{"exclude a directory", nil, []string{"node_modules"}, []string{"README.md", "internal/x/x.go", "internal/x/x.js", "main.go", "main_test.go", "web/app.js", "web/style.css"}},
+		{"exclude by path", nil, []string{"internal/*", "*_test.go"}, []string{"README.md", "main.go", "web/app.js", "web/node_modules/lib/index.js", "web/node_modules/lib/lib.go", "web/style.css"}},
+		{"both", []string{"*.js"}, []string{"node_modules"}, []string{"internal/x/x.js", "web/app.js"}},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Include = tt.include
+		opts.Exclude = tt.exclude
+		md := walk(t, repoTree(), ".", opts)
+		if got := files(md); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: walked %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalkPrunesExcludedDirectories(t *testing.T) {
+	fsys := &faultyFS{fsys: repoTree()}
+	opts := DefaultOptions()
+	opts.Exclude = []string{"node_modules"}
+	md := walk(t, fsys, ".", opts)
+	if find(&md, "web/node_modules") != nil {
+		t.Error("excluded directory listed")
+	}
+	if fsys.calls["readdir web"] == 0 {
+		t.Fatal("the walk's calls weren't recorded")
+	}
+	for call := range fsys.calls {
+		if call == "readdir web/node_modules" || call == "lstat web/node_modules/lib" {
+			t.Errorf("walked into the excluded directory: %s", call)
+		}
+	}
+	if web := find(&md, "web"); web.FileCount != 2 {
+		t.Errorf("web counts %d files, want the 2 left", web.FileCount)
+	}
+}
+
+func TestWalkRejectsBadPatterns(t *testing.T) {
+	for _, opts := range []Options{{Include: []string{"[a-"}}, {Exclude: []string{"ok", "\\"}}} {
+		if _, err := Walk(context.Background(), repoTree(), ".", opts); err == nil || !errors.Is(err, path.ErrBadPattern) {
+			t.Errorf("include %q, exclude %q: Walk = %v, want ErrBadPattern", opts.Include, opts.Exclude, err)
+		}
+	}
+}
+
+func TestWalkSkipsHiddenWithoutDescending(t *testing.T) {
+	fsys := &faultyFS{fsys: fstest.MapFS{".hidden": file("h"), ".git/objects/ab": file("obj"), "a.txt": file("a")}}
+	opts := DefaultOptions()
+	opts.SkipHidden = true
+	md := walk(t, fsys, ".", opts)
+	if got := files(md); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("walked %q, want only a.txt", got)
+	}
+	for call := range fsys.calls {
+		if strings.Contains(call, ".git") || strings.Contains(call, ".hidden") {
+			t.Errorf("looked at a hidden entry: %s", call)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ignoreRule is one pattern line from a .gitignore file.
+type ignoreRule struct {
+	// base is the directory holding the .gitignore; the rule only applies
+	// beneath it.
+	base string
+	// segments is the pattern split on slashes. Unanchored patterns start
+	// with "**" so they match at any depth.
+	segments []string
+	negate bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules in effect for one directory, outermost
+// .gitignore first, so later rules override earlier ones as in git.
+type ignoreRules []ignoreRule
+
+// parseGitignore reads the rules in a .gitignore file found in dir.
+func parseGitignore(dir string, data []byte) ignoreRules {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// A slash anywhere but the end ties the pattern to dir; otherwise
+		// it matches a name at any level below it.
+		anchored := strings.Contains(line, "/")
+		rule.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		if !anchored {
+			rule.segments = append([]string{"**"}, rule.segments...)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// readGitignore returns the rules in dir's .gitignore, or none if there
+// isn't one. Anything but a regular file is passed over rather than read,
+// since reading a pipe would block.
+func readGitignore(fsys fs.FS, dir string) (ignoreRules, error) {
+	name := path.Join(dir, ".gitignore")
+	fi, err := fs.Stat(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseGitignore(dir, data), nil
+}
+
+func hasGitignore(files []fs.DirEntry) bool {
+	for _, f := range files {
+		if f.Name() == ".gitignore" && f.Type().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// gitignoresAbove collects the rules from the .gitignore files in every
+// directory above name, so walking a subdirectory ignores the same paths
+// as walking the whole tree.
+func gitignoresAbove(fsys fs.FS, name string) (ignoreRules, error) {
+	if name == "." {
+		return nil, nil
+	}
+	dirs := []string{"."}
+	if parent := path.Dir(name); parent != "." {
+		elems := strings.Split(parent, "/")
+		for i := range elems {
+			dirs = append(dirs, strings.Join(elems[:i+1], "/"))
+		}
+	}
+
+	var rules ignoreRules
+	for _, dir := range dirs {
+		more, err := readGitignore(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		rules = rules.with(more)
+	}
+	return rules, nil
+}
+
+// with returns rules followed by more, without sharing storage with any
+// other directory's rules.
+func (rules ignoreRules) with(more ignoreRules) ignoreRules {
+	if len(more) == 0 {
+		return rules
+	}
+	return append(rules[:len(rules):len(rules)], more...)
+}
+
+// ignored reports whether name is ignored. The last matching rule decides,
+// so a negated pattern can bring back something an earlier one ignored.
+func (rules ignoreRules) ignored(name string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		rel := name
+		if r.base != "." {
+			var ok bool
+			if rel, ok = strings.CutPrefix(name, r.base+"/"); !ok {
+				continue
+			}
+		}
+		if matchSegments(r.segments, strings.Split(rel, "/")) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches a path against a pattern one element at a time. A
+// "**" element matches any number of path elements, but at least one
+// when it ends the pattern, so "dir/**" matches what is inside dir and
+// not dir itself.
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		min := 0
+		if len(pattern) == 1 {
+			min = 1
+		}
+		for i := min; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := parseGitignore(".", []byte("# build output\nbuild/\n*.log\n!keep.log\n/root-only.txt\ndocs/**/*.tmp\n\\#hash\n"))
+	for _, tt := range []struct {
+		name string
+		isDir bool
+		want bool
+	}{
+		{"build", true, true},
+		// build/ only names directories.
+		{"build", false, false},
+		{"sub/build", true, true},
+		{"a.log", false, true},
+		{"sub/deep/b.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"root-only.txt", false, true},
+		{"sub/root-only.txt", false, false},
+		{"docs/a/b/c.tmp", false, true},
+		{"docs/c.tmp", false, true},
+		{"other/c.tmp", false, false},
+		{"#hash", false, true},
+		{"main.go", false, false},
+	} {
+		if got := rules.ignored(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, dir %t) = %t, want %t", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+
+	// Rules from a nested .gitignore only apply beneath it.
+	nested := parseGitignore("sub", []byte("*.txt\n"))
+	if !nested.ignored("sub/a.txt", false) || nested.ignored("a.txt", false) || nested.ignored("subway/a.txt", false) {
+		t.Error("a rule from sub/.gitignore applied outside sub")
+	}
+}
+
+func TestWalkGitignore(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitignore": file("build/\n*.log\n!important.log\n"),
+		"main.go": file("package main"),
+		"debug.log": file("noise"),
+		"important.log": file("signal"),
+		"build/out.bin": file("binary"),
+		"sub/.gitignore": file("*.tmp\n!*.log\n"),
+		"sub/a.tmp": file("tmp"),
+		"sub/b.log": file("log"),
+		"sub/c.go": file("package sub"),
+		"sub/build/x": file("x"),
+	}
+	want := []string{".gitignore", "important.log", "main.go", "sub/.gitignore", "sub/b.log", "sub/c.go"}
+	opts := DefaultOptions()
+	opts.Gitignore = true
+	md := walk(t, fsys, ".", opts)
+	if got := files(md); !slices.Equal(got, want) {
+		t.Errorf("walked %q, want %q", got, want)
+	}
+	if find(&md, "build") != nil || find(&md, "sub/build") != nil {
+		t.Error("an ignored directory was listed")
+	}
+
+	// Walking a subdirectory still applies the .gitignore above it.
+	sub := walk(t, fsys, "sub", opts)
+	if got := files(sub); !slices.Equal(got, want[3:]) {
+		t.Errorf("walking sub: %q, want %q", got, want[3:])
+	}
+
+	if got := files(walk(t, fsys, ".", DefaultOptions())); len(got) != len(fsys) {
+		t.Errorf("without Gitignore walked %d files, want all %d", len(got), len(fsys))
+	}
+}
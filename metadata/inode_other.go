@@ -0,0 +1,8 @@
+//go:build !unix
+
+package metadata
+
+import "io/fs"
+
+// setInode is a no-op where files have no inode numbers to report.
+func setInode(m *FileMetadata, fi fs.FileInfo) {}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package metadata
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func setInode(m *FileMetadata, fi fs.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino, dev := uint64(st.Ino), uint64(st.Dev)
+		m.Inode, m.Dev = &ino, &dev
+	}
+}
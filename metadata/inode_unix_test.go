@@ -0,0 +1,41 @@
+//go:build unix
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkReportsInodes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("a", "shared")
+	writeFile("other", "shared")
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Skipf("link: %v", err)
+	}
+
+	md := walk(t, os.DirFS(dir), ".", DefaultOptions())
+	a, b, other := find(&md, "a"), find(&md, "b"), find(&md, "other")
+	for _, f := range []*FileMetadata{&md, a, b, other} {
+		if f.Inode == nil || f.Dev == nil {
+			t.Fatalf("%s: no inode or device", f.Path)
+		}
+	}
+	if *a.Inode != *b.Inode || *a.Dev != *b.Dev {
+		t.Errorf("hard links a and b are inodes %d and %d on %d and %d", *a.Inode, *b.Inode, *a.Dev, *b.Dev)
+	}
+	// The same contents in another file is still another file.
+	if *other.Inode == *a.Inode {
+		t.Errorf("other shares a's inode %d", *a.Inode)
+	}
+	if *md.Dev != *a.Dev {
+		t.Errorf("root on device %d, a on %d", *md.Dev, *a.Dev)
+	}
+}
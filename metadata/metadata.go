@@ -0,0 +1,472 @@
+// Package metadata walks a file tree and reports, for every entry, its last
+// modification time and how large it would be once compressed. Directories are
+// walked concurrently, with the number of open files bounded by a Limiter.
+package metadata
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+type FileMetadata struct {
+	Filename string `json:"filename" xml:"filename"`
+	// Type is "file", "directory", "symlink", "device", "socket", "pipe"
+	// or "other". A followed link has its target's type.
+	Type string `json:"type,omitempty" xml:"type,omitempty"`
+	// Path is the entry's slash-separated name within the walked file
+	// system, such as "sub/dir/file.txt".
+	Path string `json:"path" xml:"path"`
+	// Depth is how far below the walked path the entry is, counting the
+	// walked path itself as 0.
+	Depth int `json:"depth" xml:"depth"`
+	LastModifiedDate time.Time `json:"last_modified_date" xml:"last_modified_date"`
+	// CreatedDate is the birth time and ChangedDate the time the inode
+	// last changed. Each is nil where the platform doesn't report it.
+	CreatedDate *time.Time `json:"created_date,omitempty" xml:"created_date,omitempty"`
+	ChangedDate *time.Time `json:"changed_date,omitempty" xml:"changed_date,omitempty"`
+	// Mode is formatted like ls, as in "-rw-r--r--", and Perm holds the
+	// permission bits as a number.
+	Mode string `json:"mode,omitempty" xml:"mode,omitempty"`
+	Perm uint32 `json:"perm,omitempty" xml:"perm,omitempty"`
+	// Uid and Gid are the owning user and group, with their names when
+	// they resolve. They are only reported on Unix.
+	Uid *uint32 `json:"uid,omitempty" xml:"uid,omitempty"`
+	Gid *uint32 `json:"gid,omitempty" xml:"gid,omitempty"`
+	Owner string `json:"owner,omitempty" xml:"owner,omitempty"`
+	Group string `json:"group,omitempty" xml:"group,omitempty"`
+	// Inode and Dev identify the file on disk, so hard links to the same
+	// file can be told apart from copies. They are only reported on Unix.
+	Inode *uint64 `json:"inode,omitempty" xml:"inode,omitempty"`
+	Dev *uint64 `json:"dev,omitempty" xml:"dev,omitempty"`
+	// FileSizeGzipped is only filled in when compressing with gzip, the
+	// default, and is nil wherever no gzip size was measured: for links
+	// and special files, directories left unwalked at the depth limit, and
+	// walks that skip compression. CompressedSize is the size under
+	// whichever algorithm was used, named by CompressionAlgo.
+	FileSizeGzipped *int64 `json:"file_size_gzipped,omitempty" xml:"file_size_gzipped,omitempty"`
+	FileSize int64 `json:"file_size" xml:"file_size"`
+	// DiskUsage is the space actually allocated, like du, which is less
+	// than FileSize for a sparse file and usually more for a small one. A
+	// directory counts its own blocks and everything below it. It is only
+	// reported on Unix.
+	DiskUsage *int64 `json:"disk_usage,omitempty" xml:"disk_usage,omitempty"`
+	CompressedSize int64 `json:"compressed_size" xml:"compressed_size"`
+	CompressionAlgo string `json:"compression_algo,omitempty" xml:"compression_algo,omitempty"`
+	// CompressionSkipped marks a file too large or too slow to compress,
+	// whose compressed size is left at zero, and a directory whose
+	// compressed size leaves out such a file.
+	CompressionSkipped bool `json:"compression_skipped,omitempty" xml:"compression_skipped,omitempty"`
+	// CompressionRatio is CompressedSize over FileSize, so smaller is
+	// better. It is left at zero for empty files and when the compressed
+	// size is unknown or incomplete.
+	CompressionRatio float64 `json:"compression_ratio,omitempty" xml:"compression_ratio,omitempty"`
+	// FileSizeHuman and CompressedSizeHuman restate the sizes for people,
+	// as in "3.4 MiB". The walk leaves them empty for callers to fill in.
+	FileSizeHuman string `json:"file_size_human,omitempty" xml:"file_size_human,omitempty"`
+	CompressedSizeHuman string `json:"compressed_size_human,omitempty" xml:"compressed_size_human,omitempty"`
+	MimeType string `json:"mime_type,omitempty" xml:"mime_type,omitempty"`
+	Checksum string `json:"checksum,omitempty" xml:"checksum,omitempty"`
+	ChecksumAlgo string `json:"checksum_algo,omitempty" xml:"checksum_algo,omitempty"`
+	IsSymlink bool `json:"is_symlink,omitempty" xml:"is_symlink,omitempty"`
+	LinkTarget string `json:"link_target,omitempty" xml:"link_target,omitempty"`
+	// RealPath is the entry's absolute path on disk with every symlink
+	// resolved. The walk leaves it empty for callers to fill in.
+	RealPath string `json:"real_path,omitempty" xml:"real_path,omitempty"`
+	Files []FileMetadata `json:"files" xml:"file"`
+	// Error says why the entry couldn't be read. A directory whose listing
+	// failed part way through carries it alongside the entries it did get.
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+	// Truncated marks a directory whose contents were not walked because
+	// the requested depth was reached.
+	Truncated bool `json:"truncated,omitempty" xml:"truncated,omitempty"`
+	// Cycle marks a followed link to a directory that is already being
+	// walked above it, whose contents are left out rather than repeated
+	// forever.
+	Cycle bool `json:"cycle,omitempty" xml:"cycle,omitempty"`
+	// OtherFilesystem marks a directory on another device whose contents
+	// were not walked because of OneFilesystem.
+	OtherFilesystem bool `json:"other_filesystem,omitempty" xml:"other_filesystem,omitempty"`
+	// FileCount and DirCount are the number of regular files and of
+	// directories anywhere below a directory.
+	FileCount int `json:"file_count,omitempty" xml:"file_count,omitempty"`
+	DirCount int `json:"dir_count,omitempty" xml:"dir_count,omitempty"`
+	// Total is the number of entries in a paged directory that pass the
+	// file filters, of which Files holds one page.
+	Total int `json:"total,omitempty" xml:"total,omitempty"`
+
+	// regular is set on regular files, including links followed to one,
+	// so their directory can count them.
+	regular bool
+}
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeNamedPipe != 0:
+		return "pipe"
+	}
+	return "other"
+}
+
+// setFileInfo copies what m reports from fi. A followed link reports its
+// target's details.
+func (m *FileMetadata) setFileInfo(fi fs.FileInfo) {
+	m.LastModifiedDate = fi.ModTime()
+	m.Type = fileType(fi.Mode())
+	m.Mode = fi.Mode().String()
+	m.Perm = uint32(fi.Mode().Perm())
+	setOwner(m, fi)
+	setTimes(m, fi)
+	setDiskUsage(m, fi)
+	setInode(m, fi)
+}
+
+func (m *FileMetadata) setCompressedSize(size int64, algo string) {
+	m.CompressedSize = size
+	m.CompressionAlgo = algo
+	if algo == "gzip" {
+		m.FileSizeGzipped = &size
+	}
+	m.setRatio()
+}
+
+func (m *FileMetadata) setRatio() {
+	if m.FileSize > 0 && !m.CompressionSkipped {
+		m.CompressionRatio = float64(m.CompressedSize) / float64(m.FileSize)
+	}
+}
+
+// Options control a single walk. Start from DefaultOptions; the zero value
+// only reports the walked path itself.
+type Options struct {
+	// SortBy orders each directory's Files by "name", "size" or "mtime".
+	SortBy string
+	Descending bool
+	// Depth is how many levels below the walked path to descend. Zero
+	// reports just that path and a negative value means no limit.
+	Depth int
+	// Offset and Limit page the walked directory's own Files, after
+	// sorting; a Limit of zero means the rest of the listing. Only the
+	// entries on the page are counted in the directory's totals. Paging
+	// by name skips walking the rest; other orders walk every entry to
+	// sort them.
+	Offset int
+	Limit int
+	// MaxDepth is a hard limit on nesting, separate from Depth, that keeps
+	// a pathologically deep tree from exhausting the process. A directory
+	// past it is reported with ErrTooDeep. Zero means no limit.
+	MaxDepth int
+	// MaxEntries, if positive, abandons the walk with ErrTooManyEntries
+	// as soon as it has visited more entries than this, so an enormous
+	// tree is refused before it is assembled.
+	MaxEntries int64
+	// SkipGzip walks the tree without compressing any files, for callers
+	// that only need names, sizes and times.
+	SkipGzip bool
+	// Compression is the algorithm compressed sizes are measured with:
+	// "gzip" (the default when empty), "brotli" or "zstd".
+	Compression string
+	// GzipLevel is the gzip level sizes are measured at, from
+	// gzip.BestSpeed to gzip.BestCompression. Zero means
+	// gzip.DefaultCompression.
+	GzipLevel int
+	// MaxCompressBytes, if positive, skips compressing files larger than
+	// this many bytes.
+	MaxCompressBytes int64
+	// CompressTimeout, if positive, bounds how long compressing one file
+	// may take. A file that runs over is reported as CompressionSkipped,
+	// as one over MaxCompressBytes is.
+	CompressTimeout time.Duration
+	// Checksum names the hash to compute over each file ("sha256", "md5"
+	// or "crc32"), or "" for none.
+	Checksum string
+	// FollowSymlinks walks through symlinks instead of reporting them.
+	// Links that resolve outside the walked file system, including any
+	// absolute target, are never followed.
+	FollowSymlinks bool
+	// OneFilesystem leaves unwalked any directory on a different device
+	// from the walked path, like find -xdev. Devices are only known on
+	// Unix; elsewhere it has no effect.
+	OneFilesystem bool
+	// Include, if not empty, keeps only the files matching one of these
+	// globs. Exclude drops every entry matching one of its globs, and an
+	// excluded directory is not walked at all. A pattern containing a
+	// slash is matched against the path within the walked file system,
+	// any other against the entry's name.
+	Include []string
+	Exclude []string
+	// MinSize and MaxSize, when positive, keep only the regular files of
+	// that many bytes or more, or at most. With either set, directories
+	// are only kept if something below them matches, and links and
+	// special files are dropped.
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter and ModifiedBefore, when not zero, likewise keep only
+	// the regular files last modified strictly inside that range.
+	ModifiedAfter time.Time
+	ModifiedBefore time.Time
+	// Regexp, if set, likewise keeps only the regular files whose path
+	// within the walked file system it matches.
+	Regexp *regexp.Regexp
+	// SkipHidden leaves out entries whose name starts with a dot, along
+	// with everything inside hidden directories.
+	SkipHidden bool
+	// Gitignore skips everything matched by the .gitignore files in the
+	// walked directories and the directories above them, following git's
+	// rules for nesting and negation.
+	Gitignore bool
+	// Retries is how many more times a stat, readlink, directory listing
+	// or open is tried after a transient error such as ESTALE, waiting
+	// RetryBackoff before the first retry and twice as long before each
+	// one after. Other errors are never retried.
+	Retries int
+	RetryBackoff time.Duration
+	// Limiter caps the number of files open at once; every descriptor a
+	// walk opens is held under one of its tokens. Share one Limiter
+	// between walks to bound a whole process; if nil, each walk gets its
+	// own of size DefaultMaxConcurrency.
+	Limiter Limiter
+	// Workers, if set, caps the goroutines walking entries. Once all of
+	// its tokens are taken, a directory walks the rest of its children
+	// itself rather than starting more. Share one between walks to bound
+	// a whole process; if nil, every entry gets a goroutine of its own.
+	//
+	// This takes the place of a fixed pool draining a queue of paths: a
+	// directory waits on its children, so a pool has to either grow or
+	// hand that wait to a continuation, whereas a directory that finds no
+	// token free just carries on with the work itself. BenchmarkWalkWide
+	// compares the two.
+	Workers Limiter
+	// Cache, if set, is consulted before reading each file and updated
+	// after. Only share a Cache between walks of the same file system.
+	Cache *Cache
+	// Stats, if set, is updated as the walk progresses.
+	Stats *Stats
+	// Emit, if set, receives every entry as soon as it is complete, with
+	// children sent before their directory. Directories are then returned
+	// without their Files, which have already been emitted, so memory use
+	// stays flat however large the tree is. Walk does not close Emit.
+	Emit chan<- FileMetadata
+}
+
+// Stats counts the work done by one or more walks. The counters are updated
+// atomically, so a Stats may be read while a walk is running.
+type Stats struct {
+	// Entries is the number of files, directories and links visited.
+	Entries atomic.Int64
+	// Goroutines is the number of goroutines started to walk entries.
+	Goroutines atomic.Int64
+}
+
+func (s *Stats) addEntry() {
+	if s != nil {
+		s.Entries.Add(1)
+	}
+}
+
+func (s *Stats) addGoroutine() {
+	if s != nil {
+		s.Goroutines.Add(1)
+	}
+}
+
+// activity is the live state of every walk in the process.
+var activity struct {
+	walks atomic.Int64
+	goroutines atomic.Int64
+	peakGoroutines atomic.Int64
+}
+
+// Activity is a snapshot of what the process's walks are doing.
+type Activity struct {
+	// Walks is the number of calls to Walk that have not yet returned.
+	Walks int64
+	// Goroutines is the number of goroutines walking entries right now,
+	// and PeakGoroutines the most there have been at once.
+	Goroutines int64
+	PeakGoroutines int64
+}
+
+// CurrentActivity reports what the process's walks are doing right now.
+func CurrentActivity() Activity {
+	return Activity{
+		Walks: activity.walks.Load(),
+		Goroutines: activity.goroutines.Load(),
+		PeakGoroutines: activity.peakGoroutines.Load(),
+	}
+}
+
+func goroutineStarted() {
+	n := activity.goroutines.Add(1)
+	for {
+		peak := activity.peakGoroutines.Load()
+		if n <= peak || activity.peakGoroutines.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func goroutineDone() { activity.goroutines.Add(-1) }
+
+// DefaultMaxConcurrency is the Limiter size used when none is given.
+var DefaultMaxConcurrency = runtime.NumCPU() * 4
+
+// DefaultMaxDepth is the MaxDepth set by DefaultOptions.
+const DefaultMaxDepth = 256
+
+// DefaultOptions walks the whole tree, sorted by name.
+func DefaultOptions() Options {
+	return Options{SortBy: "name", Depth: -1, MaxDepth: DefaultMaxDepth}
+}
+
+func (o Options) gzipLevel() int {
+	if o.GzipLevel == 0 {
+		return gzip.DefaultCompression
+	}
+	return o.GzipLevel
+}
+
+func (o Options) compression() string {
+	if o.Compression == "" {
+		return "gzip"
+	}
+	return o.Compression
+}
+
+// Validate reports the first invalid setting in o.
+func (o Options) Validate() error {
+	switch o.SortBy {
+	case "", "name", "size", "mtime":
+	default:
+		return fmt.Errorf("invalid sort %q: must be one of name, size, mtime", o.SortBy)
+	}
+	if o.Offset < 0 || o.Limit < 0 {
+		return fmt.Errorf("offset and limit must not be negative")
+	}
+	if o.MaxEntries < 0 {
+		return fmt.Errorf("max entries must not be negative")
+	}
+	if o.Retries < 0 || o.RetryBackoff < 0 {
+		return fmt.Errorf("retries and retry backoff must not be negative")
+	}
+	switch o.Compression {
+	case "", "gzip", "brotli", "zstd":
+	default:
+		return fmt.Errorf("invalid compression %q: must be one of gzip, brotli, zstd", o.Compression)
+	}
+	if o.GzipLevel != gzip.DefaultCompression && (o.GzipLevel < 0 || o.GzipLevel > gzip.BestCompression) {
+		return fmt.Errorf("invalid gzip level %d: must be from %d to %d", o.GzipLevel, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if o.Checksum != "" {
+		if _, err := newChecksum(o.Checksum); err != nil {
+			return err
+		}
+	}
+	if err := validatePatterns(o.Include); err != nil {
+		return err
+	}
+	return validatePatterns(o.Exclude)
+}
+
+// Limiter caps the number of files open, or goroutines running, at once
+// across one or more walks.
+type Limiter chan struct{}
+
+// NewLimiter returns a Limiter that allows n at once.
+func NewLimiter(n int) Limiter {
+	return make(Limiter, n)
+}
+
+// acquire blocks until a token is free or ctx is cancelled.
+func (l Limiter) acquire(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes a token if one is free, without waiting.
+func (l Limiter) tryAcquire() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l Limiter) release() { <-l }
+
+// Walk reports the metadata for name in fsys and, if it is a directory,
+// everything beneath it. Symlinks are only recognised if fsys implements
+// fs.ReadLinkFS. The error is non-nil only when name itself cannot be
+// walked; failures further down are recorded in the Error field of the
+// affected entries and the rest of the tree is still returned.
+func Walk(ctx context.Context, fsys fs.FS, name string, opts Options) (FileMetadata, error) {
+	if err := opts.Validate(); err != nil {
+		return FileMetadata{}, err
+	}
+	if !fs.ValidPath(name) {
+		return FileMetadata{}, &fs.PathError{Op: "walk", Path: name, Err: fs.ErrInvalid}
+	}
+	if opts.Limiter == nil {
+		opts.Limiter = NewLimiter(DefaultMaxConcurrency)
+	}
+	activity.walks.Add(1)
+	defer activity.walks.Add(-1)
+
+	wo := walkOptions{Options: opts, realPath: name}
+	if opts.Gitignore {
+		if err := opts.Limiter.acquire(ctx); err != nil {
+			return FileMetadata{}, err
+		}
+		var err error
+		wo.ignores, err = gitignoresAbove(fsys, name)
+		opts.Limiter.release()
+		if err != nil {
+			return FileMetadata{}, err
+		}
+	}
+	if opts.FollowSymlinks {
+		realPath, err := evalSymlinks(fsys, path.Dir(name))
+		if err != nil {
+			return FileMetadata{}, err
+		}
+		wo.realPath = path.Join(realPath, path.Base(name))
+	}
+
+	if opts.MaxEntries > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		wo.budget = &entryBudget{exceeded: cancel}
+		wo.budget.left.Store(opts.MaxEntries)
+	}
+
+	c := make(chan result, 1)
+	go walkRecovered(ctx, fsys, name, wo, c)
+	res := <-c
+	if errors.Is(context.Cause(ctx), ErrTooManyEntries) {
+		return FileMetadata{}, ErrTooManyEntries
+	}
+	return res.result, res.error
+}
@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// LimitOpenFiles returns fsys with every descriptor it opens held under
+// one of l's tokens, from Open until Close and for the length of a
+// ReadDir or ReadFile. Share one Limiter across everything in the
+// process that opens files so their total stays under the descriptor
+// rlimit. Stat, Lstat and ReadLink hold no descriptor and aren't limited.
+//
+// Open can't be cancelled, so a caller must not wait on other work while it
+// holds a file open.
+func LimitOpenFiles(fsys fs.FS, l Limiter) fs.FS {
+	return limitedFS{fsys, l}
+}
+
+type limitedFS struct {
+	fsys fs.FS
+	limit Limiter
+}
+
+func (l limitedFS) Open(name string) (fs.File, error) {
+	l.limit.acquire(context.Background())
+	f, err := l.fsys.Open(name)
+	if err != nil {
+		l.limit.release()
+		return nil, err
+	}
+	lf := &limitedFile{File: f, release: sync.OnceFunc(l.limit.release)}
+	// Downloads are served with http.ServeContent, which needs to seek.
+	if s, ok := f.(io.Seeker); ok {
+		return seekableFile{lf, s}, nil
+	}
+	return lf, nil
+}
+
+func (l limitedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	l.limit.acquire(context.Background())
+	defer l.limit.release()
+	return fs.ReadDir(l.fsys, name)
+}
+
+func (l limitedFS) ReadFile(name string) ([]byte, error) {
+	l.limit.acquire(context.Background())
+	defer l.limit.release()
+	return fs.ReadFile(l.fsys, name)
+}
+
+func (l limitedFS) Stat(name string) (fs.FileInfo, error) {
+	if _, ok := l.fsys.(fs.StatFS); ok {
+		return fs.Stat(l.fsys, name)
+	}
+	f, err := l.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (l limitedFS) Lstat(name string) (fs.FileInfo, error) { return fs.Lstat(l.fsys, name) }
+
+func (l limitedFS) ReadLink(name string) (string, error) { return fs.ReadLink(l.fsys, name) }
+
+// limitedFile gives its token back when it is first closed.
+type limitedFile struct {
+	fs.File
+	release func()
+}
+
+func (f *limitedFile) Close() error {
+	defer f.release()
+	return f.File.Close()
+}
+
+// ReadDir lists a directory opened with Open, as fs.ReadDirFile does.
+func (f *limitedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Err: fs.ErrInvalid}
+	}
+	return d.ReadDir(n)
+}
+
+type seekableFile struct {
+	*limitedFile
+	io.Seeker
+}
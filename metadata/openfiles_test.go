@@ -0,0 +1,126 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingFS records the most descriptors fsys had open at once. Each
+// Open takes a millisecond so that the walk's opens overlap.
+type countingFS struct {
+	fsys fs.FS
+	mu sync.Mutex
+	open, peak int
+}
+
+func (c *countingFS) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open++
+	c.peak = max(c.peak, c.open)
+}
+
+func (c *countingFS) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.enter()
+	time.Sleep(time.Millisecond)
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		c.leave()
+		return nil, err
+	}
+	return &countedFile{f, c}, nil
+}
+
+func (c *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.enter()
+	defer c.leave()
+	return fs.ReadDir(c.fsys, name)
+}
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(c.fsys, name) }
+func (c *countingFS) Lstat(name string) (fs.FileInfo, error) { return fs.Lstat(c.fsys, name) }
+func (c *countingFS) ReadLink(name string) (string, error) { return fs.ReadLink(c.fsys, name) }
+
+type countedFile struct {
+	fs.File
+	c *countingFS
+}
+
+func (f *countedFile) Close() error {
+	defer f.c.leave()
+	return f.File.Close()
+}
+
+func TestLimitOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	const files = 500
+	for i := range files {
+		content := strings.Repeat(fmt.Sprintf("file %d\n", i), 100)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%03d.txt", i)), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const limit = 3
+	counter := &countingFS{fsys: os.DirFS(dir)}
+	fsys := LimitOpenFiles(counter, NewLimiter(limit))
+	// The walk's own Limiter is far larger, so only the descriptor
+	// Limiter holds it back.
+	opts := DefaultOptions()
+	opts.Limiter = NewLimiter(64)
+	md, err := Walk(context.Background(), fsys, ".", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.FileCount != files {
+		t.Errorf("FileCount = %d, want %d", md.FileCount, files)
+	}
+	for _, f := range md.Files {
+		if f.Error != "" {
+			t.Errorf("%s: %s", f.Path, f.Error)
+		}
+	}
+	if counter.peak > limit {
+		t.Errorf("%d descriptors open at once, want at most %d", counter.peak, limit)
+	}
+	if counter.open != 0 {
+		t.Errorf("%d descriptors still open after the walk", counter.open)
+	}
+}
+
+func TestLimitOpenFilesKeepsSeeker(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(1)
+	fsys := LimitOpenFiles(os.DirFS(dir), l)
+	f, err := fsys.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(interface{ Seek(int64, int) (int64, error) }); !ok {
+		t.Error("opened file is not an io.Seeker")
+	}
+	if len(l) != 1 {
+		t.Errorf("%d tokens held while open, want 1", len(l))
+	}
+	f.Close()
+	f.Close()
+	if len(l) != 0 {
+		t.Errorf("%d tokens held after Close, want 0", len(l))
+	}
+}
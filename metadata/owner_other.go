@@ -0,0 +1,8 @@
+//go:build !unix
+
+package metadata
+
+import "io/fs"
+
+// setOwner is a no-op where files have no Unix owner.
+func setOwner(m *FileMetadata, fi fs.FileInfo) {}
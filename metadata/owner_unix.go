@@ -0,0 +1,51 @@
+//go:build unix
+
+package metadata
+
+import (
+	"io/fs"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// userNames and groupNames cache id lookups, which read /etc/passwd and
+// /etc/group or ask NSS every time otherwise. Ids that don't resolve are
+// cached as "".
+var userNames, groupNames sync.Map
+
+func setOwner(m *FileMetadata, fi fs.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	uid, gid := uint32(st.Uid), uint32(st.Gid)
+	m.Uid, m.Gid = &uid, &gid
+	m.Owner = lookupName(&userNames, uid, func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+	m.Group = lookupName(&groupNames, gid, func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
+
+func lookupName(cache *sync.Map, id uint32, lookup func(string) (string, error)) string {
+	if name, ok := cache.Load(id); ok {
+		return name.(string)
+	}
+	name, err := lookup(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		name = ""
+	}
+	cache.Store(id, name)
+	return name
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+package metadata
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWalkReportsOwner(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mine"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	md := walk(t, os.DirFS(dir), "mine", DefaultOptions())
+	if md.Uid == nil || md.Gid == nil {
+		t.Fatal("no uid or gid reported")
+	}
+	if int(*md.Uid) != os.Geteuid() || int(*md.Gid) != os.Getegid() {
+		t.Errorf("uid %d, gid %d; want the process's %d and %d", *md.Uid, *md.Gid, os.Geteuid(), os.Getegid())
+	}
+	if u, err := user.Current(); err == nil && md.Owner != u.Username {
+		t.Errorf("owner %q, want %q", md.Owner, u.Username)
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(os.Getegid())); err == nil && md.Group != g.Name {
+		t.Errorf("group %q, want %q", md.Group, g.Name)
+	}
+	if _, ok := userNames.Load(*md.Uid); !ok {
+		t.Error("the owner's name wasn't cached")
+	}
+
+	// A file system without Unix stat data reports no owner.
+	if md := walk(t, fstest.MapFS{"f": file("x")}, "f", DefaultOptions()); md.Uid != nil || md.Owner != "" {
+		t.Errorf("MapFS file owned by %v %q", md.Uid, md.Owner)
+	}
+}
+
+func TestLookupNameCaches(t *testing.T) {
+	var cache sync.Map
+	calls := 0
+	lookup := func(id string) (string, error) {
+		calls++
+		if id == "7" {
+			return "seven", nil
+		}
+		return "", user.UnknownUserIdError(8)
+	}
+	for range 3 {
+		if got := lookupName(&cache, 7, lookup); got != "seven" {
+			t.Errorf("lookupName(7) = %q", got)
+		}
+		if got := lookupName(&cache, 8, lookup); got != "" {
+			t.Errorf("lookupName(8) = %q, want empty for an unknown id", got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("looked up %d times, want once for each id", calls)
+	}
+}
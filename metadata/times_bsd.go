@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package metadata
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+func setTimes(m *FileMetadata, fi fs.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		created := time.Unix(st.Birthtimespec.Unix())
+		changed := time.Unix(st.Ctimespec.Unix())
+		m.CreatedDate, m.ChangedDate = &created, &changed
+	}
+}
@@ -0,0 +1,27 @@
+//go:build darwin || freebsd || netbsd
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalkReportsBirthAndChangeTimes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	md := walk(t, os.DirFS(dir), "f", DefaultOptions())
+	for name, tm := range map[string]*time.Time{"created": md.CreatedDate, "changed": md.ChangedDate} {
+		if tm == nil || tm.IsZero() {
+			t.Errorf("no %s time reported", name)
+			continue
+		}
+		if since := time.Since(*tm); since < -time.Minute || since > time.Minute {
+			t.Errorf("%s %s, want about now", name, tm)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package metadata
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// setTimes reports the change time. Linux only exposes birth time through
+// statx, which fs.FileInfo doesn't carry.
+func setTimes(m *FileMetadata, fi fs.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		changed := time.Unix(st.Ctim.Unix())
+		m.ChangedDate = &changed
+	}
+}
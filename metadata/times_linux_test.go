@@ -0,0 +1,35 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalkReportsChangeTime(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "f")
+	if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Backdating the mtime updates the ctime, so the two come apart.
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+	md := walk(t, os.DirFS(dir), "f", DefaultOptions())
+	if md.ChangedDate == nil {
+		t.Fatal("no change time reported")
+	}
+	if since := time.Since(*md.ChangedDate); since < -time.Minute || since > time.Minute {
+		t.Errorf("changed %s, want about now", md.ChangedDate)
+	}
+	if !md.LastModifiedDate.Before(md.ChangedDate.Add(-time.Hour)) {
+		t.Errorf("modified %s and changed %s, want the backdated mtime", md.LastModifiedDate, md.ChangedDate)
+	}
+	// Birth time needs statx, which fs.FileInfo doesn't carry.
+	if md.CreatedDate != nil {
+		t.Errorf("created %s, want it left out on Linux", md.CreatedDate)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package metadata
+
+import "io/fs"
+
+// setTimes is a no-op where the creation and change times aren't known.
+func setTimes(m *FileMetadata, fi fs.FileInfo) {}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package metadata
+
+// transient reports no errors as worth retrying where there is no errno to
+// tell them apart.
+func transient(err error) bool { return false }
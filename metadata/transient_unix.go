@@ -0,0 +1,14 @@
+//go:build unix
+
+package metadata
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transient reports whether err is worth retrying: the kind of hiccup a
+// network file system gives back under load or after a server restart.
+func transient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ESTALE)
+}
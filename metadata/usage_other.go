@@ -0,0 +1,8 @@
+//go:build !unix
+
+package metadata
+
+import "io/fs"
+
+// setDiskUsage is a no-op where the allocated size isn't reported.
+func setDiskUsage(m *FileMetadata, fi fs.FileInfo) {}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package metadata
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// setDiskUsage reports the space allocated to the file, which st_blocks
+// counts in 512-byte units whatever the file system's block size.
+func setDiskUsage(m *FileMetadata, fi fs.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		usage := int64(st.Blocks) * 512
+		m.DiskUsage = &usage
+	}
+}
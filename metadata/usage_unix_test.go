@@ -0,0 +1,53 @@
+//go:build unix
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWalkReportsDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	// A sparse file: 64 MiB long, with only its last bytes written.
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 64 << 20
+	if _, err := f.WriteAt([]byte("end"), size-3); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dense"), make([]byte, 64<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.SkipGzip = true
+	md := walk(t, os.DirFS(dir), ".", opts)
+	sparse, dense := find(&md, "sparse"), find(&md, "dense")
+	if sparse.FileSize != size || sparse.DiskUsage == nil {
+		t.Fatalf("sparse: %d bytes using %v, want %d and its usage", sparse.FileSize, sparse.DiskUsage, size)
+	}
+	if *sparse.DiskUsage >= size/2 {
+		t.Skipf("sparse file uses %d bytes; the file system doesn't support holes", *sparse.DiskUsage)
+	}
+	if dense.DiskUsage == nil || *dense.DiskUsage < dense.FileSize {
+		t.Errorf("dense: %d bytes using %v, want at least its size allocated", dense.FileSize, dense.DiskUsage)
+	}
+	// A directory adds its own blocks to its files'.
+	if md.DiskUsage == nil || *md.DiskUsage < *sparse.DiskUsage+*dense.DiskUsage {
+		t.Errorf("root uses %v, want at least its files' %d", md.DiskUsage, *sparse.DiskUsage+*dense.DiskUsage)
+	}
+
+	// A file system without stat buffers has no usage to report.
+	md = walk(t, fstest.MapFS{"a": file("a")}, "a", opts)
+	if md.DiskUsage != nil {
+		t.Errorf("MapFS file uses %d bytes, want no usage", *md.DiskUsage)
+	}
+}
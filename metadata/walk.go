@@ -0,0 +1,636 @@
+package metadata
+
+import (
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// walkOptions carries Options down the recursion along with the state the
+// walk keeps for itself.
+type walkOptions struct {
+	Options
+	// realPath is the current node's path with symlinks resolved when
+	// following links, and its name otherwise.
+	realPath string
+	// ancestors holds the real paths of the directories above the current
+	// node.
+	ancestors *pathChain
+	// level is how far the current node is below the walked path.
+	level int
+	// ignores are the .gitignore rules from the directories above the
+	// current node, when Gitignore is set.
+	ignores ignoreRules
+	// budget counts down the entries MaxEntries allows; nil means no
+	// limit.
+	budget *entryBudget
+	// rootDev is the device of the walked path, nil where it isn't known.
+	rootDev *uint64
+}
+
+// entryBudget is shared by every node of one walk.
+type entryBudget struct {
+	left atomic.Int64
+	// exceeded cancels the walk once the budget runs out.
+	exceeded context.CancelCauseFunc
+}
+
+// take spends one entry, cancelling the walk if none were left.
+func (b *entryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	if b.left.Add(-1) < 0 {
+		b.exceeded(ErrTooManyEntries)
+		return false
+	}
+	return true
+}
+
+var errOutsideFS = errors.New("symlink points outside the file system")
+
+// ErrTooManyEntries is returned by Walk when the tree holds more entries
+// than Options.MaxEntries allows.
+var ErrTooManyEntries = errors.New("too many entries")
+
+// ErrTooDeep is recorded for a directory nested further below the walked
+// path than Options.MaxDepth allows.
+var ErrTooDeep = errors.New("maximum depth exceeded")
+
+// maxLinkHops bounds how many symlinks evalSymlinks will follow for one
+// path, so a link loop fails instead of spinning.
+const maxLinkHops = 255
+
+// evalSymlinks resolves every symlink in name, like filepath.EvalSymlinks
+// but confined to fsys: an absolute target, or one that climbs above the
+// root of fsys, is reported as errOutsideFS.
+func evalSymlinks(fsys fs.FS, name string) (string, error) {
+	resolved := "."
+	rest := strings.Split(name, "/")
+	hops := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "." {
+				return "", errOutsideFS
+			}
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		fi, err := fs.Lstat(fsys, next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxLinkHops {
+			return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: errors.New("too many links")}
+		}
+		target, err := fs.ReadLink(fsys, next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", errOutsideFS
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// pathChain is a linked list of paths from a node up to the walk's root.
+// Each level only links to its parent, so siblings can share it safely.
+type pathChain struct {
+	path string
+	parent *pathChain
+}
+
+func (p *pathChain) contains(path string) bool {
+	for ; p != nil; p = p.parent {
+		if p.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+type result struct {
+	result FileMetadata
+	error error
+}
+
+// errorResult reports a failed entry. The metadata still names the entry and
+// carries the error so a parent directory can include it in its listing
+// instead of failing the whole tree.
+func errorResult(name string, err error) result {
+	return result{FileMetadata{Filename: path.Base(name), Error: err.Error()}, err}
+}
+
+// errVanished marks the result for an entry that was deleted after its
+// directory was listed, and errFiltered one dropped by the file filters.
+// The parent leaves both out.
+var (
+	errVanished = errors.New("entry vanished during the walk")
+	errFiltered = errors.New("entry filtered out")
+)
+
+func (r result) dropped() bool {
+	return r.error == errVanished || r.error == errFiltered
+}
+
+// vanished is the result for a failure touching name. A child that no
+// longer exists is dropped, since the directory listing was only a
+// snapshot; any other error, or the walked path itself not existing, is
+// reported as usual.
+func vanished(name string, level int, err error) result {
+	if level > 0 && errors.Is(err, fs.ErrNotExist) {
+		return result{error: errVanished}
+	}
+	return errorResult(name, err)
+}
+
+// retry calls op until it succeeds, fails with an error that isn't
+// transient, or has been retried opts.Retries times, backing off between
+// attempts.
+func retry[T any](ctx context.Context, opts walkOptions, op func() (T, error)) (T, error) {
+	backoff := opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		v, err := op()
+		if err == nil || attempt >= opts.Retries || !transient(err) {
+			return v, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return v, err
+		}
+		backoff *= 2
+	}
+}
+
+// report delivers res to the parent directory and, when streaming, to
+// Options.Emit as well.
+func report(ctx context.Context, name string, opts walkOptions, res result, resultChan chan result) {
+	res.result.Path = name
+	res.result.Depth = opts.level
+	if res.error == nil && opts.filteredOut(res.result) {
+		res = result{error: errFiltered}
+	}
+	// Nothing more is streamed once the walk has been abandoned.
+	if opts.Emit != nil && !res.dropped() && ctx.Err() == nil {
+		select {
+		case opts.Emit <- res.result:
+		case <-ctx.Done():
+		}
+	}
+	resultChan <- res
+}
+
+// walkRecovered runs filepathToJSONMetadata in a goroutine of its own,
+// turning a panic into an error for that entry. A panic in a walk
+// goroutine cannot be caught by the caller and would take down the process.
+func walkRecovered(ctx context.Context, fsys fs.FS, name string, opts walkOptions, resultChan chan result) {
+	defer func() {
+		if p := recover(); p != nil {
+			report(ctx, name, opts, errorResult(name, fmt.Errorf("panic walking %s: %v", name, p)), resultChan)
+		}
+	}()
+	filepathToJSONMetadata(ctx, fsys, name, opts, resultChan)
+}
+
+func filepathToJSONMetadata(ctx context.Context, fsys fs.FS, name string, opts walkOptions, resultChan chan result) {
+	send := func(res result) { report(ctx, name, opts, res, resultChan) }
+
+	if err := ctx.Err(); err != nil {
+		send(errorResult(name, err))
+		return
+	}
+
+	fileInfo, err := retry(ctx, opts, func() (fs.FileInfo, error) { return fs.Lstat(fsys, name) })
+	if err != nil {
+		send(vanished(name, opts.level, err))
+		return
+	}
+	opts.Stats.addEntry()
+	if !opts.budget.take() {
+		send(errorResult(name, ErrTooManyEntries))
+		return
+	}
+
+	md := FileMetadata{Filename: fileInfo.Name()}
+	md.setFileInfo(fileInfo)
+
+	if fileInfo.Mode()&fs.ModeSymlink != 0 {
+		md.IsSymlink = true
+		md.LinkTarget, err = retry(ctx, opts, func() (string, error) { return fs.ReadLink(fsys, name) })
+		if err != nil {
+			send(errorResult(name, err))
+			return
+		}
+		if !opts.FollowSymlinks {
+			send(result{md, nil})
+			return
+		}
+
+		// Following a link must not lead out of fsys.
+		opts.realPath, err = evalSymlinks(fsys, opts.realPath)
+		if errors.Is(err, errOutsideFS) {
+			send(result{md, nil})
+			return
+		}
+		if err != nil {
+			send(errorResult(name, err))
+			return
+		}
+
+		fileInfo, err = retry(ctx, opts, func() (fs.FileInfo, error) { return fs.Stat(fsys, opts.realPath) })
+		if err != nil {
+			send(errorResult(name, err))
+			return
+		}
+		md.setFileInfo(fileInfo)
+	}
+
+	if opts.level == 0 {
+		opts.rootDev = md.Dev
+	}
+	if fileInfo.IsDir() {
+		md.MimeType = directoryMimeType
+		if opts.OneFilesystem && opts.rootDev != nil && md.Dev != nil && *md.Dev != *opts.rootDev {
+			md.OtherFilesystem = true
+			send(result{md, nil})
+			return
+		}
+		if opts.Depth == 0 {
+			md.Truncated = true
+			send(result{md, nil})
+			return
+		}
+		if opts.MaxDepth > 0 && opts.level >= opts.MaxDepth {
+			send(errorResult(name, &fs.PathError{Op: "walk", Path: name, Err: ErrTooDeep}))
+			return
+		}
+		childOpts := opts
+		childOpts.level++
+		if childOpts.Depth > 0 {
+			childOpts.Depth--
+		}
+
+		// When following symlinks, remember the real path of every
+		// directory on the way down so a link back to one of them is
+		// reported as a cycle instead of walked forever.
+		if opts.FollowSymlinks {
+			if opts.ancestors.contains(opts.realPath) {
+				md.Cycle = true
+				send(result{md, nil})
+				return
+			}
+			childOpts.ancestors = &pathChain{opts.realPath, opts.ancestors}
+		}
+
+		if err := opts.Limiter.acquire(ctx); err != nil {
+			send(errorResult(name, err))
+			return
+		}
+		files, err := retry(ctx, opts, func() ([]fs.DirEntry, error) { return fs.ReadDir(fsys, name) })
+		// ReadDir returns whatever it read before failing, so one bad
+		// entry needn't lose the whole listing: walk what there is and
+		// record the error on the directory.
+		var listErr error
+		if err != nil && len(files) > 0 {
+			listErr, err = err, nil
+		}
+		if err == nil && opts.Gitignore && hasGitignore(files) {
+			var rules ignoreRules
+			rules, err = readGitignore(fsys, name)
+			childOpts.ignores = opts.ignores.with(rules)
+		}
+		opts.Limiter.release()
+		if err != nil {
+			send(vanished(name, opts.level, err))
+			return
+		}
+
+		children := make([]fs.DirEntry, 0, len(files))
+		for _, file := range files {
+			child := path.Join(name, file.Name())
+			if opts.skip(child, file.IsDir()) || childOpts.ignores.ignored(child, file.IsDir()) {
+				continue
+			}
+			children = append(children, file)
+		}
+
+		// Only the walked directory itself is paged. fs.ReadDir sorts by
+		// name, so a page in name order can be cut before walking and the
+		// entries off the page are never visited. Which entries the file
+		// filters drop isn't known until they are walked, so a filtered
+		// listing is paged, and counted, afterwards.
+		paged := opts.level == 0 && (opts.Offset > 0 || opts.Limit > 0)
+		pagedByName := paged && !opts.filtersFiles() && (opts.SortBy == "" || opts.SortBy == "name")
+		if pagedByName {
+			md.Total = len(children)
+			if opts.Descending {
+				slices.Reverse(children)
+			}
+			children = page(children, opts.Offset, opts.Limit)
+		}
+
+		var wg = sync.WaitGroup{}
+		c := make(chan result, len(children))
+
+		for _, file := range children {
+			if ctx.Err() != nil {
+				break
+			}
+			childOpts := childOpts
+			childOpts.realPath = path.Join(opts.realPath, file.Name())
+			child := path.Join(name, file.Name())
+
+			// With every worker busy, walk the child here instead. c has
+			// room for every child, so this never waits on the others.
+			if opts.Workers != nil && !opts.Workers.tryAcquire() {
+				walkRecovered(ctx, fsys, child, childOpts, c)
+				continue
+			}
+			wg.Add(1)
+			opts.Stats.addGoroutine()
+			goroutineStarted()
+			go func() {
+				defer wg.Done()
+				// Count the goroutine done before giving its token back,
+				// so there are never more running than Workers allows.
+				if opts.Workers != nil {
+					defer opts.Workers.release()
+				}
+				defer goroutineDone()
+				walkRecovered(ctx, fsys, child, childOpts, c)
+			}()
+		}
+
+		go func() {
+			wg.Wait()
+			close(c)
+		}()
+
+		subfiles := make([]FileMetadata, 0, len(children))
+		for res := range c {
+			if !res.dropped() {
+				subfiles = append(subfiles, res.result)
+			}
+		}
+
+		// A cancelled walk leaves the listing incomplete, so don't pass
+		// it off as a result.
+		if err := ctx.Err(); err != nil {
+			send(errorResult(name, err))
+			return
+		}
+
+		// Results arrive in completion order; sort so responses are stable.
+		sortFiles(subfiles, opts.SortBy, opts.Descending)
+		if paged && !pagedByName {
+			md.Total = len(subfiles)
+			subfiles = page(subfiles, opts.Offset, opts.Limit)
+		}
+
+		// Children report their own subtree totals, so summing them here
+		// rolls sizes and counts up the tree without walking it again. A
+		// paged directory only counts the page.
+		var gzipped int64
+		for _, f := range subfiles {
+			if f.FileSizeGzipped != nil {
+				gzipped += *f.FileSizeGzipped
+			}
+			md.CompressedSize += f.CompressedSize
+			md.CompressionSkipped = md.CompressionSkipped || f.CompressionSkipped
+			md.FileSize += f.FileSize
+			if md.DiskUsage != nil && f.DiskUsage != nil {
+				*md.DiskUsage += *f.DiskUsage
+			}
+			switch {
+			case f.regular:
+				md.FileCount++
+			case f.MimeType == directoryMimeType:
+				md.DirCount += 1 + f.DirCount
+				md.FileCount += f.FileCount
+			}
+		}
+		if !opts.SkipGzip {
+			md.CompressionAlgo = opts.compression()
+			md.setRatio()
+			if opts.compression() == "gzip" {
+				md.FileSizeGzipped = &gzipped
+			}
+		}
+
+		if opts.Emit == nil {
+			md.Files = subfiles
+		}
+		if listErr != nil {
+			md.Error = listErr.Error()
+		}
+
+		send(result{md, nil})
+		return
+	}
+
+	md.FileSize = fileInfo.Size()
+	md.regular = fileInfo.Mode().IsRegular()
+	// Opening a pipe blocks until there is a writer and a device may
+	// never reach EOF, so only regular files are read.
+	if !md.regular {
+		md.MimeType = specialMimeType(fileInfo.Mode())
+		send(result{md, nil})
+		return
+	}
+	if opts.SkipGzip {
+		send(result{md, nil})
+		return
+	}
+
+	// Compressing huge files dominates a walk, so past the limit only the
+	// cheap parts are done.
+	skipCompression := opts.MaxCompressBytes > 0 && md.FileSize > opts.MaxCompressBytes
+
+	if cached, ok := opts.Cache.get(opts.realPath, fileInfo.ModTime(), md.FileSize, opts.Options); ok && !skipCompression {
+		md.setCompressedSize(cached.compressed, opts.compression())
+		md.MimeType = cached.mimeType
+		if cached.checksum != "" {
+			md.Checksum = cached.checksum
+			md.ChecksumAlgo = opts.Checksum
+		}
+		send(result{md, nil})
+		return
+	}
+
+	// The result goes out only once the file is closed and its token given
+	// back, so an entry waiting for Emit to drain never holds a descriptor
+	// that whoever drains it, an archive adding files, may be waiting for.
+	var final *result
+	defer func() {
+		if final != nil {
+			report(ctx, name, opts, *final, resultChan)
+		}
+	}()
+	send = func(res result) { final = &res }
+
+	// Hold a token only while the file is open so a directory waiting on
+	// its children never blocks them from making progress.
+	if err := opts.Limiter.acquire(ctx); err != nil {
+		send(errorResult(name, err))
+		return
+	}
+	defer opts.Limiter.release()
+
+	file, err := retry(ctx, opts, func() (fs.File, error) { return fsys.Open(name) })
+	if err != nil {
+		send(vanished(name, opts.level, err))
+		return
+	}
+	defer file.Close()
+
+	// CompressTimeout covers every read of the file, from sniffing its
+	// type to the end of the compression.
+	readCtx := ctx
+	if opts.CompressTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, opts.CompressTimeout)
+		defer cancel()
+	}
+	// A file that is too slow to read is skipped like one that is too
+	// large, without a checksum since it was not read to the end. It
+	// isn't cached, so the next walk tries again.
+	tooSlow := func(err error) bool {
+		return err != nil && ctx.Err() == nil && readCtx.Err() != nil
+	}
+
+	mimeType, contents, err := detectMimeType(fileInfo.Name(), contextReader{readCtx, file})
+	if tooSlow(err) {
+		md.CompressionSkipped = true
+		send(result{md, nil})
+		return
+	}
+	if err != nil {
+		send(errorResult(name, err))
+		return
+	}
+	md.MimeType = mimeType
+
+	// Hash in the same pass as the gzip so the file is only read once.
+	var checksum hash.Hash
+	if opts.Checksum != "" {
+		checksum, err = newChecksum(opts.Checksum)
+		if err != nil {
+			send(errorResult(name, err))
+			return
+		}
+		contents = io.TeeReader(contents, checksum)
+	}
+
+	if skipCompression {
+		md.CompressionSkipped = true
+		if checksum != nil {
+			_, err := io.Copy(io.Discard, contents)
+			if tooSlow(err) {
+				send(result{md, nil})
+				return
+			}
+			if err != nil {
+				send(errorResult(name, err))
+				return
+			}
+			md.Checksum = hex.EncodeToString(checksum.Sum(nil))
+			md.ChecksumAlgo = opts.Checksum
+		}
+		send(result{md, nil})
+		return
+	}
+
+	size, err := compressedSize(contents, opts.compression(), opts.gzipLevel())
+	if tooSlow(err) {
+		md.CompressionSkipped = true
+		send(result{md, nil})
+		return
+	}
+	if err != nil {
+		send(errorResult(name, err))
+		return
+	}
+	md.setCompressedSize(size, opts.compression())
+
+	if checksum != nil {
+		md.Checksum = hex.EncodeToString(checksum.Sum(nil))
+		md.ChecksumAlgo = opts.Checksum
+	}
+	opts.Cache.put(cacheEntry{
+		name: opts.realPath,
+		modTime: fileInfo.ModTime(),
+		size: md.FileSize,
+		checksumAlgo: opts.Checksum,
+		compression: opts.compression(),
+		gzipLevel: opts.gzipLevel(),
+		compressed: md.CompressedSize,
+		mimeType: md.MimeType,
+		checksum: md.Checksum,
+	})
+	send(result{md, nil})
+}
+
+// page returns the limit items of s starting at offset, or all of the rest
+// when limit is zero.
+func page[T any](s []T, offset, limit int) []T {
+	if offset >= len(s) {
+		return s[len(s):]
+	}
+	s = s[offset:]
+	if limit > 0 && limit < len(s) {
+		s = s[:limit]
+	}
+	return s
+}
+
+// sortFiles orders a directory listing by name, size or mtime. Ties on size
+// and mtime fall back to the name so the order is always deterministic.
+func sortFiles(files []FileMetadata, by string, descending bool) {
+	less := func(a, b FileMetadata) bool {
+		switch by {
+		case "size":
+			if a.FileSize != b.FileSize {
+				return a.FileSize < b.FileSize
+			}
+		case "mtime":
+			if !a.LastModifiedDate.Equal(b.LastModifiedDate) {
+				return a.LastModifiedDate.Before(b.LastModifiedDate)
+			}
+		}
+		return a.Filename < b.Filename
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if descending {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+}
@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"io/fs"
+	"path"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// deviceFS reports every entry on device 1 except those under the
+// directories in devs, which are on the device given. Stat_t's field
+// types vary between platforms, so it is built for Linux alone.
+type deviceFS struct {
+	fstest.MapFS
+	devs map[string]uint64
+}
+
+type deviceInfo struct {
+	fs.FileInfo
+	st *syscall.Stat_t
+}
+
+func (i deviceInfo) Sys() any { return i.st }
+
+func (d deviceFS) info(name string, fi fs.FileInfo, err error) (fs.FileInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	dev := uint64(1)
+	for p := name; p != "."; p = path.Dir(p) {
+		if n, ok := d.devs[p]; ok {
+			dev = n
+			break
+		}
+	}
+	return deviceInfo{fi, &syscall.Stat_t{Dev: dev, Ino: uint64(len(name))}}, nil
+}
+
+func (d deviceFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := d.MapFS.Stat(name)
+	return d.info(name, fi, err)
+}
+
+func (d deviceFS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := d.MapFS.Lstat(name)
+	return d.info(name, fi, err)
+}
+
+func TestWalkOneFilesystem(t *testing.T) {
+	fsys := deviceFS{
+		MapFS: fstest.MapFS{
+			"local/a.txt": file("a"),
+			"mnt/b.txt": file("bb"),
+			"mnt/deep/c.txt": file("ccc"),
+			"top.txt": file("t"),
+		},
+		devs: map[string]uint64{"mnt": 2},
+	}
+	opts := DefaultOptions()
+	md := walk(t, fsys, ".", opts)
+	if f := find(&md, "mnt/deep/c.txt"); f == nil || md.FileCount != 4 {
+		t.Fatalf("without -one-filesystem: %d files, mnt/deep/c.txt %+v; want all 4", md.FileCount, f)
+	}
+
+	opts.OneFilesystem = true
+	md = walk(t, fsys, ".", opts)
+	mnt := find(&md, "mnt")
+	if mnt == nil || !mnt.OtherFilesystem || mnt.Files != nil || find(&md, "mnt/b.txt") != nil {
+		t.Errorf("mnt: got %+v, want it marked and not walked", mnt)
+	}
+	if f := find(&md, "local/a.txt"); f == nil || md.FileCount != 2 {
+		t.Errorf("%d files, local/a.txt %+v; want the 2 on the root's device", md.FileCount, f)
+	}
+	// Walking from the other device stays on that one instead.
+	md = walk(t, fsys, "mnt", opts)
+	if md.OtherFilesystem || md.FileCount != 2 {
+		t.Errorf("walking mnt: other filesystem %t with %d files, want its 2", md.OtherFilesystem, md.FileCount)
+	}
+}
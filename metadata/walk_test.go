@@ -0,0 +1,1205 @@
+package metadata
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// modTime is the mtime of every file in the test trees.
+var modTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// wideTree is dirs directories of files files each, every file a few
+// hundred bytes of text.
+func wideTree(dirs, files int) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for d := range dirs {
+		for f := range files {
+			data := strings.Repeat(fmt.Sprintf("line %d of file %d in dir %d\n", f, f, d), 10)
+			fsys[fmt.Sprintf("d%03d/f%03d.txt", d, f)] = &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: modTime}
+		}
+	}
+	return fsys
+}
+
+// file is a regular file holding data.
+func file(data string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: modTime}
+}
+
+// dir is an empty directory.
+func dir() *fstest.MapFile {
+	return &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: modTime}
+}
+
+// find returns the entry at p in the tree rooted at md, or nil.
+func find(md *FileMetadata, p string) *FileMetadata {
+	if md.Path == p {
+		return md
+	}
+	for i := range md.Files {
+		if f := find(&md.Files[i], p); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// faultyFS fails calls on chosen names with err. fail maps "op name",
+// where op is open, readdir or lstat, to how many calls fail before one
+// succeeds, or to -1 to fail every one. Each call first waits delay.
+type faultyFS struct {
+	fsys fs.FS
+	err error
+	delay time.Duration
+	mu sync.Mutex
+	fail map[string]int
+	calls map[string]int
+}
+
+func (f *faultyFS) fault(op, name string) error {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := op + " " + name
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[key]++
+	switch n := f.fail[key]; {
+	case n < 0:
+		return &fs.PathError{Op: op, Path: name, Err: f.err}
+	case n > 0:
+		f.fail[key]--
+		return &fs.PathError{Op: op, Path: name, Err: f.err}
+	}
+	return nil
+}
+
+func (f *faultyFS) Open(name string) (fs.File, error) {
+	if err := f.fault("open", name); err != nil {
+		return nil, err
+	}
+	return f.fsys.Open(name)
+}
+
+func (f *faultyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.fault("readdir", name); err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(f.fsys, name)
+}
+
+func (f *faultyFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := f.fault("lstat", name); err != nil {
+		return nil, err
+	}
+	return fs.Lstat(f.fsys, name)
+}
+
+func (f *faultyFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(f.fsys, name) }
+func (f *faultyFS) ReadLink(name string) (string, error) { return fs.ReadLink(f.fsys, name) }
+
+func walk(t testing.TB, fsys fs.FS, name string, opts Options) FileMetadata {
+	t.Helper()
+	md, err := Walk(context.Background(), fsys, name, opts)
+	if err != nil {
+		t.Fatalf("Walk(%q): %v", name, err)
+	}
+	return md
+}
+
+func TestWalkBoundsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	const dirs, files = 20, 50
+	for d := range dirs {
+		sub := filepath.Join(dir, fmt.Sprintf("d%02d", d))
+		if err := os.Mkdir(sub, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for f := range files {
+			if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%03d", f)), []byte(strings.Repeat("x", f)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	const limit = 4
+	counter := &countingFS{fsys: os.DirFS(dir)}
+	opts := DefaultOptions()
+	opts.Limiter = NewLimiter(limit)
+	md, err := Walk(context.Background(), counter, ".", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.FileCount != dirs*files || md.DirCount != dirs {
+		t.Errorf("walked %d files in %d directories, want %d in %d", md.FileCount, md.DirCount, dirs*files, dirs)
+	}
+	for _, d := range md.Files {
+		for _, f := range d.Files {
+			if f.Error != "" {
+				t.Errorf("%s: %s", f.Path, f.Error)
+			}
+		}
+	}
+	if counter.peak > limit {
+		t.Errorf("%d descriptors open at once, want at most %d", counter.peak, limit)
+	}
+}
+
+// peakFS records the most goroutines walking entries at once, as seen
+// from each file opened. The pause lets the goroutines pile up.
+type peakFS struct {
+	fstest.MapFS
+	peak atomic.Int64
+}
+
+func (p *peakFS) Open(name string) (fs.File, error) {
+	n := activity.goroutines.Load()
+	for peak := p.peak.Load(); n > peak && !p.peak.CompareAndSwap(peak, n); peak = p.peak.Load() {
+	}
+	time.Sleep(200 * time.Microsecond)
+	return p.MapFS.Open(name)
+}
+
+func TestWalkWorkersSameOutput(t *testing.T) {
+	fsys := wideTree(20, 20)
+	want := walk(t, fsys, ".", DefaultOptions())
+	for _, n := range []int{1, 2, 8} {
+		opts := DefaultOptions()
+		opts.Workers = NewLimiter(n)
+		pfs := &peakFS{MapFS: fsys}
+		got := walk(t, pfs, ".", opts)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Workers %d: tree differs from one walked with a goroutine per entry", n)
+		}
+		// The walk's own goroutine carries on when every worker is busy,
+		// so at most n more are ever running, and with files as slow as
+		// these to open they all get used.
+		if peak := pfs.peak.Load(); peak != int64(n) {
+			t.Errorf("Workers %d: %d goroutines walking at once, want %d", n, peak, n)
+		}
+	}
+}
+
+// BenchmarkWalkWide compares a goroutine per entry with the Workers bound
+// on a wide tree, compressing as a listing does and with SkipGzip, where the
+// scheduling is most of the cost.
+func BenchmarkWalkWide(b *testing.B) {
+	fsys := wideTree(50, 50)
+	workers := []struct {
+		name string
+		n int
+	}{
+		{"per-entry", 0},
+		{"workers=NumCPU", runtime.NumCPU()},
+		{"workers=4xNumCPU", 4 * runtime.NumCPU()},
+		{"workers=256", 256},
+	}
+	for _, skip := range []bool{false, true} {
+		for _, w := range workers {
+			name := w.name
+			if skip {
+				name += "/skip-gzip"
+			}
+			b.Run(name, func(b *testing.B) {
+				stats := &Stats{}
+				b.ReportAllocs()
+				for b.Loop() {
+					opts := DefaultOptions()
+					opts.SkipGzip = skip
+					opts.Stats = stats
+					if w.n > 0 {
+						opts.Workers = NewLimiter(w.n)
+					}
+					walk(b, fsys, ".", opts)
+				}
+				b.ReportMetric(float64(stats.Goroutines.Load())/float64(b.N), "goroutines/op")
+			})
+		}
+	}
+}
+
+func TestWalkRecordsEntryErrors(t *testing.T) {
+	fsys := &faultyFS{
+		fsys: fstest.MapFS{
+			"a/ok.txt": file("fine"),
+			"a/bad.txt": file("unreadable"),
+			"locked/x.txt": file("x"),
+			"top.txt": file("top"),
+		},
+		err: fs.ErrPermission,
+		fail: map[string]int{"open a/bad.txt": -1, "readdir locked": -1},
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+
+	for _, p := range []string{"a/bad.txt", "locked"} {
+		f := find(&md, p)
+		if f == nil {
+			t.Fatalf("%s missing from the tree", p)
+		}
+		if !strings.Contains(f.Error, "permission denied") {
+			t.Errorf("%s: Error = %q, want a permission error", p, f.Error)
+		}
+	}
+	for _, p := range []string{"a/ok.txt", "top.txt"} {
+		f := find(&md, p)
+		if f == nil || f.Error != "" || f.FileSize == 0 {
+			t.Errorf("%s: got %+v, want it listed without an error", p, f)
+		}
+	}
+}
+
+// partialFS lists only the first keep entries of each directory in fail,
+// returning err along with them, as os.ReadDir does when it fails part way.
+type partialFS struct {
+	fstest.MapFS
+	fail map[string]int
+	err error
+}
+
+func (p partialFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := p.MapFS.ReadDir(name)
+	if keep, ok := p.fail[name]; ok && err == nil {
+		return entries[:keep], &fs.PathError{Op: "readdirent", Path: name, Err: p.err}
+	}
+	return entries, err
+}
+
+func TestWalkPartialReadDir(t *testing.T) {
+	fsys := partialFS{
+		MapFS: fstest.MapFS{
+			"d/a.txt": file("aa"),
+			"d/b.txt": file("bbb"),
+			"d/c.txt": file("c"),
+			"none/x.txt": file("x"),
+			"ok/y.txt": file("y"),
+		},
+		fail: map[string]int{"d": 2, "none": 0},
+		err: errors.New("input/output error"),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+
+	// The entries read before the failure are walked, and the failure is
+	// recorded on the directory.
+	d := find(&md, "d")
+	if !strings.Contains(d.Error, "input/output error") {
+		t.Errorf("d: error %q, want the listing's", d.Error)
+	}
+	var names []string
+	for _, f := range d.Files {
+		names = append(names, f.Filename)
+	}
+	if !slices.Equal(names, []string{"a.txt", "b.txt"}) || d.FileCount != 2 || d.FileSize != 5 {
+		t.Errorf("d: files %q, %d of %d bytes; want a.txt and b.txt totalled", names, d.FileCount, d.FileSize)
+	}
+	if f := find(&md, "d/a.txt"); f.Error != "" || f.CompressedSize == 0 {
+		t.Errorf("d/a.txt: %+v, want it walked in full", f)
+	}
+	// With nothing read the directory fails as before.
+	if none := find(&md, "none"); !strings.Contains(none.Error, "input/output error") || none.Files != nil {
+		t.Errorf("none: error %q with %d files, want the error and no listing", none.Error, len(none.Files))
+	}
+	if ok := find(&md, "ok"); ok.Error != "" || ok.FileCount != 1 {
+		t.Errorf("ok: error %q with %d files", ok.Error, ok.FileCount)
+	}
+	if md.FileCount != 3 {
+		t.Errorf("root counts %d files, want the 3 that were listed", md.FileCount)
+	}
+}
+
+func TestWalkUnreadableFileOnDisk(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read a file with no permissions")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ok.txt"), []byte("ok"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+	md := walk(t, os.DirFS(dir), ".", DefaultOptions())
+	if f := find(&md, "secret"); f == nil || !strings.Contains(f.Error, "permission denied") {
+		t.Errorf("secret: got %+v, want a permission error", f)
+	}
+	if f := find(&md, "ok.txt"); f == nil || f.Error != "" {
+		t.Errorf("ok.txt: got %+v, want it listed without an error", f)
+	}
+}
+
+func TestWalkMissingRoot(t *testing.T) {
+	_, err := Walk(context.Background(), fstest.MapFS{"a": file("a")}, "missing", DefaultOptions())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Walk of a missing path: error %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestWalkReportsRawAndGzippedSize(t *testing.T) {
+	data := strings.Repeat("hello, gzip\n", 1000)
+	md := walk(t, fstest.MapFS{"hello.txt": file(data)}, "hello.txt", DefaultOptions())
+	if md.FileSize != int64(len(data)) {
+		t.Errorf("FileSize = %d, want %d", md.FileSize, len(data))
+	}
+	want, err := bufferedSize([]byte(data), "gzip", gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.FileSizeGzipped == nil || *md.FileSizeGzipped != want {
+		t.Errorf("FileSizeGzipped = %v, want %d", md.FileSizeGzipped, want)
+	}
+	if md.CompressedSize != want {
+		t.Errorf("CompressedSize = %d, want %d", md.CompressedSize, want)
+	}
+}
+
+func TestWalkDirectoryGzippedSize(t *testing.T) {
+	fsys := fstest.MapFS{
+		"d/a.txt": file(strings.Repeat("a", 1000)),
+		"d/b.txt": file(strings.Repeat("b", 1000)),
+		"empty": dir(),
+		"deep/er/c.txt": file("c"),
+		"tofile": link("d/a.txt"),
+	}
+	opts := DefaultOptions()
+	opts.Depth = 2
+	md := walk(t, fsys, ".", opts)
+
+	// A directory with data claims the sum of its files, never 0.
+	d := find(&md, "d")
+	a, b := find(&md, "d/a.txt"), find(&md, "d/b.txt")
+	if d.FileSizeGzipped == nil || *d.FileSizeGzipped == 0 || *d.FileSizeGzipped != *a.FileSizeGzipped+*b.FileSizeGzipped {
+		t.Errorf("d: file_size_gzipped %v, want %d+%d", d.FileSizeGzipped, *a.FileSizeGzipped, *b.FileSizeGzipped)
+	}
+	// An empty directory really does gzip to nothing.
+	if e := find(&md, "empty"); e.FileSizeGzipped == nil || *e.FileSizeGzipped != 0 {
+		t.Errorf("empty: file_size_gzipped %v, want 0", e.FileSizeGzipped)
+	}
+	// Nothing was measured under a directory cut off at the depth limit,
+	// or for a link.
+	for _, p := range []string{"deep/er", "tofile"} {
+		if f := find(&md, p); f.FileSizeGzipped != nil {
+			t.Errorf("%s: file_size_gzipped %d, want none", p, *f.FileSizeGzipped)
+		}
+	}
+	enc, err := json.Marshal(find(&md, "deep/er"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(enc), "file_size_gzipped") {
+		t.Errorf("deep/er encodes as %s, want no file_size_gzipped", enc)
+	}
+
+	// Nor anywhere when compression is skipped or isn't gzip.
+	for _, algo := range []string{"", "zstd"} {
+		opts := DefaultOptions()
+		opts.SkipGzip = algo == ""
+		opts.Compression = algo
+		md := walk(t, fsys, ".", opts)
+		if md.FileSizeGzipped != nil || find(&md, "d").FileSizeGzipped != nil {
+			t.Errorf("compression %q: file_size_gzipped %v and %v, want none", algo, md.FileSizeGzipped, find(&md, "d").FileSizeGzipped)
+		}
+	}
+}
+
+// checkRollUp checks that every directory under md totals up its children.
+func checkRollUp(t *testing.T, md FileMetadata) {
+	t.Helper()
+	if md.Type != "directory" {
+		return
+	}
+	var size, gzipped, compressed int64
+	var files, dirs int
+	for _, f := range md.Files {
+		checkRollUp(t, f)
+		size += f.FileSize
+		gzipped += *f.FileSizeGzipped
+		compressed += f.CompressedSize
+		if f.Type == "directory" {
+			dirs += 1 + f.DirCount
+			files += f.FileCount
+		} else {
+			files++
+		}
+	}
+	if md.FileSize != size || *md.FileSizeGzipped != gzipped || md.CompressedSize != compressed {
+		t.Errorf("%s: sizes %d, %d, %d; want the children's sums %d, %d, %d", md.Path, md.FileSize, *md.FileSizeGzipped, md.CompressedSize, size, gzipped, compressed)
+	}
+	if md.FileCount != files || md.DirCount != dirs {
+		t.Errorf("%s: %d files and %d directories, want %d and %d", md.Path, md.FileCount, md.DirCount, files, dirs)
+	}
+}
+
+func TestWalkRollsUpDirectories(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt": file(strings.Repeat("a", 100)),
+		"x/b.txt": file(strings.Repeat("b", 200)),
+		"x/y/c.txt": file(strings.Repeat("c", 300)),
+		"x/y/d.txt": file(strings.Repeat("d", 400)),
+		"x/y/z/e.txt": file(strings.Repeat("e", 500)),
+		"x/empty": dir(),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+	checkRollUp(t, md)
+
+	for _, tt := range []struct {
+		path string
+		size int64
+		files, dirs int
+	}{
+		{".", 1500, 5, 4},
+		{"x", 1400, 4, 3},
+		{"x/y", 1200, 3, 1},
+		{"x/y/z", 500, 1, 0},
+		{"x/empty", 0, 0, 0},
+	} {
+		f := find(&md, tt.path)
+		if f == nil {
+			t.Fatalf("%s missing", tt.path)
+		}
+		if f.FileSize != tt.size || f.FileCount != tt.files || f.DirCount != tt.dirs {
+			t.Errorf("%s: size %d, %d files, %d directories; want %d, %d, %d", tt.path, f.FileSize, f.FileCount, f.DirCount, tt.size, tt.files, tt.dirs)
+		}
+	}
+}
+
+func TestWalkOrderIsStable(t *testing.T) {
+	fsys := wideTree(5, 30)
+	fsys["B.txt"] = file("upper")
+	fsys["a.txt"] = file("lower")
+	names := func(md FileMetadata) []string {
+		var out []string
+		for _, f := range md.Files {
+			out = append(out, f.Path)
+			for _, g := range f.Files {
+				out = append(out, g.Path)
+			}
+		}
+		return out
+	}
+	opts := DefaultOptions()
+	opts.SkipGzip = true
+	want := names(walk(t, fsys, ".", opts))
+	if want[0] != "B.txt" || want[1] != "a.txt" {
+		t.Errorf("names start %q, want B.txt before a.txt as case-sensitive order puts it", want[:2])
+	}
+	for range 20 {
+		if got := names(walk(t, fsys, ".", opts)); !slices.Equal(got, want) {
+			t.Fatalf("order changed between walks:\n%q\n%q", got, want)
+		}
+	}
+}
+
+func TestWalkSort(t *testing.T) {
+	at := func(data string, days int) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: modTime.AddDate(0, 0, days)}
+	}
+	fsys := fstest.MapFS{
+		"b": at("sized 22 bytes of text", 3),
+		"a": at("size 9..", 1),
+		"c": at("x", 2),
+		"d": at("x", 0),
+	}
+	tests := []struct {
+		by string
+		descending bool
+		want []string
+	}{
+		{"name", false, []string{"a", "b", "c", "d"}},
+		{"name", true, []string{"d", "c", "b", "a"}},
+		// Ties are broken by name.
+		{"size", false, []string{"c", "d", "a", "b"}},
+		{"size", true, []string{"b", "a", "d", "c"}},
+		{"mtime", false, []string{"d", "a", "c", "b"}},
+		{"mtime", true, []string{"b", "c", "a", "d"}},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.SortBy, opts.Descending = tt.by, tt.descending
+		md := walk(t, fsys, ".", opts)
+		var got []string
+		for _, f := range md.Files {
+			got = append(got, f.Filename)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sort %s, descending %t: %q, want %q", tt.by, tt.descending, got, tt.want)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.SortBy = "colour"
+	if _, err := Walk(context.Background(), fsys, ".", opts); err == nil {
+		t.Error("Walk with SortBy colour succeeded, want an error")
+	}
+}
+
+func TestWalkDepth(t *testing.T) {
+	fsys := fstest.MapFS{
+		"top.txt": file("t"),
+		"one/a.txt": file("a"),
+		"one/two/b.txt": file("b"),
+		"one/two/three/c.txt": file("c"),
+	}
+	tests := []struct {
+		depth int
+		listed []string
+		truncated []string
+	}{
+		{0, []string{"."}, []string{"."}},
+		{1, []string{"one", "top.txt"}, []string{"one"}},
+		{2, []string{"one", "one/a.txt", "one/two", "top.txt"}, []string{"one/two"}},
+		{-1, []string{"one", "one/a.txt", "one/two", "one/two/b.txt", "one/two/three", "one/two/three/c.txt", "top.txt"}, nil},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Depth = tt.depth
+		md := walk(t, fsys, ".", opts)
+		var listed, truncated []string
+		var visit func(FileMetadata)
+		visit = func(m FileMetadata) {
+			if m.Truncated {
+				truncated = append(truncated, m.Path)
+				if m.Files != nil {
+					t.Errorf("depth %d: %s is truncated but lists %d files", tt.depth, m.Path, len(m.Files))
+				}
+			}
+			for _, f := range m.Files {
+				listed = append(listed, f.Path)
+				visit(f)
+			}
+		}
+		if tt.depth == 0 {
+			listed = append(listed, md.Path)
+		}
+		visit(md)
+		if !slices.Equal(listed, tt.listed) || !slices.Equal(truncated, tt.truncated) {
+			t.Errorf("depth %d: listed %q, truncated %q; want %q, %q", tt.depth, listed, truncated, tt.listed, tt.truncated)
+		}
+	}
+}
+
+func TestWalkMaxEntries(t *testing.T) {
+	// 20 directories of 50 files, and the root: 1021 entries.
+	fsys := &faultyFS{fsys: wideTree(20, 50)}
+	opts := DefaultOptions()
+	opts.MaxEntries = 100
+	opts.Limiter = NewLimiter(2)
+	if _, err := Walk(context.Background(), fsys, ".", opts); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("Walk over 1021 entries with a limit of 100: %v, want ErrTooManyEntries", err)
+	}
+	// The walk gave up rather than reading the whole tree first.
+	if n := opens(fsys); n >= 1000 {
+		t.Errorf("opened %d of 1000 files before giving up", n)
+	}
+
+	opts.MaxEntries = 1021
+	if md := walk(t, fsys, ".", opts); md.FileCount != 1000 {
+		t.Errorf("%d files at exactly the limit, want all 1000", md.FileCount)
+	}
+}
+
+func TestWalkReportsDepth(t *testing.T) {
+	fsys := fstest.MapFS{
+		"top.txt": file("t"),
+		"a/one.txt": file("1"),
+		"a/b/two.txt": file("2"),
+		"a/b/c/three.txt": file("3"),
+		"a/b/c/empty": dir(),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+	for p, want := range map[string]int{
+		".": 0, "top.txt": 1, "a": 1, "a/one.txt": 2, "a/b": 2,
+		"a/b/two.txt": 3, "a/b/c": 3, "a/b/c/three.txt": 4, "a/b/c/empty": 4,
+	} {
+		if f := find(&md, p); f.Depth != want {
+			t.Errorf("%s: depth %d, want %d", p, f.Depth, want)
+		}
+	}
+	// Depth counts from the walked path, not the root of fsys.
+	md = walk(t, fsys, "a/b", DefaultOptions())
+	if md.Depth != 0 || find(&md, "a/b/c/three.txt").Depth != 2 {
+		t.Errorf("walking a/b: depths %d and %d, want 0 and 2", md.Depth, find(&md, "a/b/c/three.txt").Depth)
+	}
+	// Streamed entries carry it too.
+	emitted := make(chan FileMetadata, 16)
+	opts := DefaultOptions()
+	opts.Emit = emitted
+	walk(t, fsys, ".", opts)
+	close(emitted)
+	depths := map[string]int{}
+	for e := range emitted {
+		depths[e.Path] = e.Depth
+	}
+	if depths["a/b/c/three.txt"] != 4 || depths["top.txt"] != 1 {
+		t.Errorf("emitted depths %v", depths)
+	}
+}
+
+func TestWalkStopsWhenCancelled(t *testing.T) {
+	fsys := &faultyFS{fsys: wideTree(40, 50), delay: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	opts := DefaultOptions()
+	opts.Limiter = NewLimiter(4)
+	start := time.Now()
+	_, err := Walk(ctx, fsys, ".", opts)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Walk error %v, want context.Canceled", err)
+	}
+	// Walking everything would take at least 2000 opens / 4 at a time.
+	if elapsed > 250*time.Millisecond {
+		t.Errorf("Walk took %s after being cancelled at 20ms", elapsed)
+	}
+	fsys.mu.Lock()
+	opened := 0
+	for key := range fsys.calls {
+		if strings.HasPrefix(key, "open ") {
+			opened++
+		}
+	}
+	fsys.mu.Unlock()
+	if opened >= 2000 {
+		t.Errorf("opened all %d files despite the cancel", opened)
+	}
+}
+
+func TestWalkMimeTypes(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	fsys := fstest.MapFS{
+		"data.json": file(`{"a": 1}`),
+		"image.png": file(png),
+		// Without an extension the contents are sniffed.
+		"blob": file("\x00\x01\x02\x03\xfe\xff"),
+		"notes": file("plain words\n"),
+		"picture": file(png),
+		"sub/x": file("x"),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+	for p, want := range map[string]string{
+		"data.json": "application/json",
+		"image.png": "image/png",
+		"blob": "application/octet-stream",
+		"notes": "text/plain; charset=utf-8",
+		"picture": "image/png",
+		"sub": "inode/directory",
+	} {
+		if f := find(&md, p); f == nil || f.MimeType != want {
+			t.Errorf("%s: got %+v, want MimeType %q", p, f, want)
+		}
+	}
+}
+
+func TestWalkChecksum(t *testing.T) {
+	for algo, want := range map[string]string{
+		"sha256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		"md5": "b1946ac92492d2347c6235b4d2611184",
+		"crc32": "363a3020",
+	} {
+		fsys := &faultyFS{fsys: fstest.MapFS{"hello": file("hello\n")}}
+		opts := DefaultOptions()
+		opts.Checksum = algo
+		md := walk(t, fsys, "hello", opts)
+		if md.Checksum != want || md.ChecksumAlgo != algo {
+			t.Errorf("%s: checksum %s %q, want %q", algo, md.ChecksumAlgo, md.Checksum, want)
+		}
+		if md.FileSizeGzipped == nil {
+			t.Errorf("%s: no gzipped size alongside the checksum", algo)
+		}
+		// The hash is taken in the same read as the gzip.
+		if n := fsys.calls["open hello"]; n != 1 {
+			t.Errorf("%s: opened the file %d times, want once", algo, n)
+		}
+	}
+
+	md := walk(t, fstest.MapFS{"hello": file("hello\n")}, "hello", DefaultOptions())
+	if md.Checksum != "" || md.ChecksumAlgo != "" {
+		t.Errorf("without Checksum: got %s %q, want none", md.ChecksumAlgo, md.Checksum)
+	}
+
+	opts := DefaultOptions()
+	opts.Checksum = "sha1"
+	if _, err := Walk(context.Background(), fstest.MapFS{"hello": file("hello\n")}, "hello", opts); err == nil {
+		t.Error("Walk with Checksum sha1 succeeded, want an error")
+	}
+}
+
+// link is a symlink to target.
+func link(target string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(target), Mode: fs.ModeSymlink | 0o777, ModTime: modTime}
+}
+
+func linkTree() fstest.MapFS {
+	return fstest.MapFS{
+		"target.txt": file("content"),
+		"dir/inner.txt": file("inner"),
+		"dir/up": link(".."),
+		"tofile": link("target.txt"),
+		"todir": link("dir"),
+		"loop": link("loop"),
+		"out": link("../outside"),
+		"abs": link("/etc"),
+	}
+}
+
+func TestWalkReportsSymlinks(t *testing.T) {
+	md := walk(t, linkTree(), ".", DefaultOptions())
+	for p, target := range map[string]string{"tofile": "target.txt", "todir": "dir", "loop": "loop", "dir/up": "..", "out": "../outside", "abs": "/etc"} {
+		f := find(&md, p)
+		if f == nil {
+			t.Fatalf("%s missing", p)
+		}
+		if !f.IsSymlink || f.LinkTarget != target || f.Type != "symlink" || f.Files != nil || f.Error != "" {
+			t.Errorf("%s: got %+v, want an unfollowed link to %s", p, f, target)
+		}
+	}
+}
+
+func TestWalkFollowsSymlinks(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FollowSymlinks = true
+	done := make(chan FileMetadata)
+	go func() { done <- walk(t, linkTree(), ".", opts) }()
+	var md FileMetadata
+	select {
+	case md = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("walk following a link loop didn't finish")
+	}
+
+	if f := find(&md, "tofile"); f == nil || f.Type != "file" || f.FileSize != int64(len("content")) || !f.IsSymlink {
+		t.Errorf("tofile: got %+v, want the target file's metadata", f)
+	}
+	if f := find(&md, "todir/inner.txt"); f == nil || f.FileSize != int64(len("inner")) {
+		t.Errorf("todir/inner.txt: got %+v, want the linked directory walked", f)
+	}
+	if f := find(&md, "dir/up"); f == nil || !f.Cycle || f.Files != nil {
+		t.Errorf("dir/up: got %+v, want a cycle back to the root, not walked", f)
+	}
+	if f := find(&md, "todir/up"); f == nil || !f.Cycle {
+		t.Errorf("todir/up: got %+v, want a cycle too", f)
+	}
+	if f := find(&md, "loop"); f == nil || f.Error == "" {
+		t.Errorf("loop: got %+v, want an error for a link to itself", f)
+	}
+	for _, p := range []string{"out", "abs"} {
+		if f := find(&md, p); f == nil || f.Type != "symlink" || f.Files != nil {
+			t.Errorf("%s: got %+v, want it left unfollowed, leading out of the file system", p, f)
+		}
+	}
+}
+
+func TestWalkDetectsCyclesOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/b", "shared"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shared", "s.txt"), []byte("s"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"a/b/root": "../..",
+		"a/b/self": ".",
+		"a/up": "..",
+		// Two links to a directory that isn't an ancestor: seen twice,
+		// but no loop.
+		"a/s1": "../shared",
+		"a/b/s2": "../../shared",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.FollowSymlinks = true
+	done := make(chan FileMetadata)
+	go func() { done <- walk(t, os.DirFS(dir), ".", opts) }()
+	var md FileMetadata
+	select {
+	case md = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("walk following links in a loop didn't finish")
+	}
+	for _, p := range []string{"a/b/root", "a/b/self", "a/up"} {
+		if f := find(&md, p); f == nil || !f.Cycle || f.Files != nil {
+			t.Errorf("%s: got %+v, want a cycle, not walked", p, f)
+		}
+	}
+	for _, p := range []string{"a/s1/s.txt", "a/b/s2/s.txt"} {
+		if f := find(&md, p); f == nil || f.FileSize != 1 {
+			t.Errorf("%s: got %+v, want the shared directory walked through each link", p, f)
+		}
+	}
+	if f := find(&md, "a/s1"); f.Cycle {
+		t.Error("a/s1 marked as a cycle")
+	}
+}
+
+func TestWalkFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt": file("a"),
+		"sub/b.txt": file("bb"),
+		"sub/deeper/c.txt": file("ccc"),
+	}
+
+	// Walk returns the tree itself, rooted wherever it is asked to start.
+	md := walk(t, fsys, "sub", DefaultOptions())
+	if md.Path != "sub" || md.Filename != "sub" || md.Type != "directory" || md.FileSize != 5 {
+		t.Errorf("sub: got path %q, name %q, type %q, size %d", md.Path, md.Filename, md.Type, md.FileSize)
+	}
+	if f := find(&md, "sub/deeper/c.txt"); f == nil || f.Filename != "c.txt" {
+		t.Errorf("sub/deeper/c.txt: got %+v", f)
+	}
+	if f := find(&md, "a.txt"); f != nil {
+		t.Error("walk of sub reached a.txt beside it")
+	}
+
+	md = walk(t, fsys, "a.txt", DefaultOptions())
+	if md.Path != "a.txt" || md.Type != "file" || md.Files != nil {
+		t.Errorf("a.txt: got %+v, want just the file", md)
+	}
+
+	for _, name := range []string{"/a.txt", "../a.txt", "sub/", "sub//b.txt", ""} {
+		if _, err := Walk(context.Background(), fsys, name, DefaultOptions()); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Walk(%q): error %v, want fs.ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestWalkNestedMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/b/c/d/e.txt": file("five"),
+		"a/b/c/d.txt": file("four"),
+		"a/b/c.txt": file("three"),
+		"a/b.txt": file("two"),
+		"a/empty/dir": dir(),
+		"z.txt": file("one"),
+	}
+	md := walk(t, fsys, ".", DefaultOptions())
+
+	want := map[string]struct {
+		typ string
+		depth int
+		size int64
+	}{
+		".": {"directory", 0, 19},
+		"a": {"directory", 1, 16},
+		"a/b": {"directory", 2, 13},
+		"a/b/c": {"directory", 3, 8},
+		"a/b/c/d": {"directory", 4, 4},
+		"a/b/c/d/e.txt": {"file", 5, 4},
+		"a/b/c/d.txt": {"file", 4, 4},
+		"a/b/c.txt": {"file", 3, 5},
+		"a/b.txt": {"file", 2, 3},
+		"a/empty": {"directory", 2, 0},
+		"a/empty/dir": {"directory", 3, 0},
+		"z.txt": {"file", 1, 3},
+	}
+	seen := 0
+	var visit func(FileMetadata)
+	visit = func(m FileMetadata) {
+		seen++
+		w, ok := want[m.Path]
+		if !ok {
+			t.Errorf("unexpected entry %s", m.Path)
+		}
+		if m.Type != w.typ || m.Depth != w.depth || m.FileSize != w.size {
+			t.Errorf("%s: %s at depth %d of size %d, want %s at %d of %d", m.Path, m.Type, m.Depth, m.FileSize, w.typ, w.depth, w.size)
+		}
+		if m.Error != "" {
+			t.Errorf("%s: %s", m.Path, m.Error)
+		}
+		for _, f := range m.Files {
+			if path.Dir(f.Path) != m.Path {
+				t.Errorf("%s listed under %s", f.Path, m.Path)
+			}
+			visit(f)
+		}
+	}
+	visit(md)
+	if seen != len(want) {
+		t.Errorf("walked %d entries, want %d", seen, len(want))
+	}
+}
+
+// panicFS panics when name is looked up, as a file system race that
+// leaves an unexpected nil might.
+type panicFS struct {
+	fstest.MapFS
+	name string
+}
+
+func (p panicFS) Lstat(name string) (fs.FileInfo, error) {
+	if name == p.name {
+		var fi fs.FileInfo
+		return fi, fmt.Errorf("size %d", fi.Size())
+	}
+	return p.MapFS.Lstat(name)
+}
+
+func TestWalkRecoversPanics(t *testing.T) {
+	fsys := panicFS{fstest.MapFS{"a.txt": file("a"), "d/boom": file("b"), "d/c.txt": file("c")}, "d/boom"}
+	for name, workers := range map[string]Limiter{"goroutine per entry": nil, "worker pool": NewLimiter(2)} {
+		opts := DefaultOptions()
+		opts.Workers = workers
+		md := walk(t, fsys, ".", opts)
+		boom := find(&md, "d/boom")
+		if boom == nil || !strings.Contains(boom.Error, "panic walking d/boom") {
+			t.Errorf("%s: d/boom = %+v, want the panic recorded as its error", name, boom)
+		}
+		if c := find(&md, "d/c.txt"); c == nil || c.Error != "" || c.FileSize != 1 {
+			t.Errorf("%s: d/c.txt next to the panic = %+v", name, c)
+		}
+		// The entry that panicked has no type, so isn't counted.
+		if md.FileCount != 2 {
+			t.Errorf("%s: walked %d files, want 2", name, md.FileCount)
+		}
+	}
+}
+
+func TestWalkCountsOnlyRegularFiles(t *testing.T) {
+	md := walk(t, linkTree(), ".", DefaultOptions())
+	// Links aren't counted, whatever they point at, and neither is the
+	// directory one of them leads to.
+	if md.FileCount != 2 || md.DirCount != 1 {
+		t.Errorf("root: %d files and %d directories, want 2 and 1", md.FileCount, md.DirCount)
+	}
+	if d := find(&md, "dir"); d.FileCount != 1 || d.DirCount != 0 {
+		t.Errorf("dir: %d files and %d directories, want 1 and 0", d.FileCount, d.DirCount)
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"file_count":2,"dir_count":1`) {
+		t.Errorf("counts missing from %s", data)
+	}
+	if f := find(&md, "target.txt"); f.FileCount != 0 || f.DirCount != 0 {
+		t.Errorf("a file carries counts %d and %d", f.FileCount, f.DirCount)
+	}
+}
+
+func TestWalkReportsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows only has a read-only bit")
+	}
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"private": 0o600, "shared": 0o644, "script": 0o750} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Chmod so the umask doesn't decide.
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "sub"), 0o710); err != nil {
+		t.Fatal(err)
+	}
+	md := walk(t, os.DirFS(dir), ".", DefaultOptions())
+	for name, want := range map[string]struct {
+		mode string
+		perm uint32
+	}{
+		"private": {"-rw-------", 0o600},
+		"shared": {"-rw-r--r--", 0o644},
+		"script": {"-rwxr-x---", 0o750},
+		"sub": {"drwx--x---", 0o710},
+	} {
+		f := find(&md, name)
+		if f.Mode != want.mode || f.Perm != want.perm {
+			t.Errorf("%s: mode %s, perm %o; want %s, %o", name, f.Mode, f.Perm, want.mode, want.perm)
+		}
+	}
+}
+
+func TestWalkEntryTypes(t *testing.T) {
+	special := func(mode fs.FileMode) *fstest.MapFile {
+		return &fstest.MapFile{Mode: mode | 0o644, ModTime: modTime}
+	}
+	fsys := &faultyFS{fsys: fstest.MapFS{
+		"file": file("data"),
+		"dir/inner": file("x"),
+		"link": link("file"),
+		"pipe": special(fs.ModeNamedPipe),
+		"null": special(fs.ModeDevice | fs.ModeCharDevice),
+		"disk": special(fs.ModeDevice),
+		"sock": special(fs.ModeSocket),
+		"odd": special(fs.ModeIrregular),
+	}}
+	md := walk(t, fsys, ".", DefaultOptions())
+	for name, want := range map[string]string{
+		".": "directory",
+		"file": "file",
+		"dir": "directory",
+		"link": "symlink",
+		"pipe": "pipe",
+		"null": "device",
+		"disk": "device",
+		"sock": "socket",
+		"odd": "other",
+	} {
+		if f := find(&md, name); f == nil || f.Type != want {
+			t.Errorf("%s: %+v, want type %s", name, f, want)
+		}
+	}
+	// Only the regular files are opened.
+	for call := range fsys.calls {
+		if strings.HasPrefix(call, "open ") && call != "open file" && call != "open dir/inner" {
+			t.Errorf("%s: only regular files should be opened", call)
+		}
+	}
+	if fsys.calls["open file"] == 0 {
+		t.Error("the regular file wasn't opened")
+	}
+	if pipe := find(&md, "pipe"); pipe.CompressedSize != 0 || pipe.FileSizeGzipped != nil || pipe.MimeType != "inode/fifo" {
+		t.Errorf("pipe reported %d compressed, gzipped %v, type %q", pipe.CompressedSize, pipe.FileSizeGzipped, pipe.MimeType)
+	}
+}
+
+func TestWalkMaxDepth(t *testing.T) {
+	deep := strings.Repeat("d/", 10) + "f.txt"
+	fsys := fstest.MapFS{deep: file("deep"), "top.txt": file("top")}
+	opts := DefaultOptions()
+	opts.MaxDepth = 4
+	md, err := Walk(context.Background(), fsys, ".", opts)
+	if err != nil {
+		t.Fatalf("Walk = %v, want the limit recorded on the entry", err)
+	}
+	tooDeep := find(&md, "d/d/d/d")
+	if tooDeep == nil || !strings.Contains(tooDeep.Error, "d/d/d/d") || !strings.Contains(tooDeep.Error, ErrTooDeep.Error()) {
+		t.Fatalf("d/d/d/d = %+v, want an error naming it and the limit", tooDeep)
+	}
+	if len(tooDeep.Files) != 0 || find(&md, "d/d/d/d/d") != nil {
+		t.Error("walked past MaxDepth")
+	}
+	if top := find(&md, "top.txt"); top == nil || top.Error != "" {
+		t.Errorf("top.txt = %+v", top)
+	}
+
+	// Asking for the entry itself stays under the limit, which counts from
+	// the walked path.
+	if md := walk(t, fsys, "d/d/d/d/d/d", opts); md.Error != "" {
+		t.Errorf("walking from d/d/d/d/d/d: %s", md.Error)
+	}
+	opts.MaxDepth = 0
+	if md := walk(t, fsys, ".", opts); find(&md, deep) == nil {
+		t.Error("MaxDepth 0 didn't walk the whole tree")
+	}
+}
+
+func TestWalkDropsEntriesThatVanish(t *testing.T) {
+	// Each entry is listed, then found gone at the next step: the stat, the
+	// open, or listing the directory.
+	fsys := &faultyFS{
+		fsys: fstest.MapFS{
+			"kept.txt": file("kept"),
+			"stat-gone.txt": file("a"),
+			"open-gone.txt": file("b"),
+			"dir-gone/x.txt": file("c"),
+			"sub/open-gone.txt": file("d"),
+			"sub/kept.txt": file("e"),
+		},
+		err: fs.ErrNotExist,
+		fail: map[string]int{
+			"lstat stat-gone.txt": -1,
+			"open open-gone.txt": -1,
+			"readdir dir-gone": -1,
+			"open sub/open-gone.txt": -1,
+		},
+	}
+	md, err := Walk(context.Background(), fsys, ".", DefaultOptions())
+	if err != nil {
+		t.Fatalf("Walk = %v, want the vanished entries dropped", err)
+	}
+	if got, want := files(md), []string{"kept.txt", "sub/kept.txt"}; !slices.Equal(got, want) {
+		t.Errorf("walked %q, want %q", got, want)
+	}
+	if find(&md, "dir-gone") != nil {
+		t.Error("the directory that vanished is still listed")
+	}
+	if md.FileCount != 2 || md.FileSize != 5 || md.DirCount != 1 {
+		t.Errorf("totals %d files of %d bytes in %d directories, want 2 of 5 in 1", md.FileCount, md.FileSize, md.DirCount)
+	}
+
+	// Only the walked path itself going missing is an error.
+	fsys.fail = map[string]int{"lstat sub": -1}
+	if _, err := Walk(context.Background(), fsys, "sub", DefaultOptions()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("walking a root that vanished: %v, want ErrNotExist", err)
+	}
+}
+
+func TestWalkPages(t *testing.T) {
+	fsys := &faultyFS{fsys: wideTree(10, 2)}
+	names := func(md FileMetadata) []string {
+		var out []string
+		for _, f := range md.Files {
+			out = append(out, f.Path)
+		}
+		return out
+	}
+	for _, tt := range []struct {
+		name string
+		offset, limit int
+		want []string
+	}{
+		{"first page", 0, 3, []string{"d000", "d001", "d002"}},
+		{"middle page", 4, 3, []string{"d004", "d005", "d006"}},
+		{"last partial page", 8, 3, []string{"d008", "d009"}},
+		{"offset past the end", 20, 3, nil},
+		{"rest of the listing", 7, 0, []string{"d007", "d008", "d009"}},
+	} {
+		clear(fsys.calls)
+		opts := DefaultOptions()
+		opts.Offset, opts.Limit = tt.offset, tt.limit
+		md := walk(t, fsys, ".", opts)
+		if got := names(md); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+		if md.Total != 10 {
+			t.Errorf("%s: total %d, want 10", tt.name, md.Total)
+		}
+		// Only the page's directories are walked, and the totals are theirs.
+		for d := range 10 {
+			name := fmt.Sprintf("d%03d", d)
+			if walked := fsys.calls["readdir "+name] > 0; walked != slices.Contains(tt.want, name) {
+				t.Errorf("%s: %s walked %t", tt.name, name, walked)
+			}
+		}
+		if md.FileCount != 2*len(tt.want) || md.DirCount != len(tt.want) {
+			t.Errorf("%s: %d files in %d directories, want the page's %d in %d", tt.name, md.FileCount, md.DirCount, 2*len(tt.want), len(tt.want))
+		}
+	}
+
+	// Paging applies to the walked directory alone.
+	opts := DefaultOptions()
+	opts.Limit = 1
+	md := walk(t, fsys, ".", opts)
+	if len(md.Files) != 1 || len(md.Files[0].Files) != 2 || md.Files[0].Total != 0 {
+		t.Errorf("the page's directory lists %d files, total %d; want both, unpaged", len(md.Files[0].Files), md.Files[0].Total)
+	}
+}
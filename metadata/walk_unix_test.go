@@ -0,0 +1,96 @@
+//go:build unix
+
+package metadata
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWalkDoesNotBlockOnFIFO(t *testing.T) {
+	dir := t.TempDir()
+	if err := unix.Mkfifo(filepath.Join(dir, "pipe"), 0o644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan FileMetadata, 1)
+	go func() { done <- walk(t, os.DirFS(dir), ".", DefaultOptions()) }()
+	select {
+	case md := <-done:
+		pipe := find(&md, "pipe")
+		if pipe == nil || pipe.Type != "pipe" || pipe.Error != "" || pipe.CompressedSize != 0 {
+			t.Errorf("pipe reported as %+v", pipe)
+		}
+		if md.FileCount != 1 || md.FileSize != 4 {
+			t.Errorf("%d files of %d bytes, want the one regular file", md.FileCount, md.FileSize)
+		}
+	case <-time.After(5 * time.Second):
+		// Opening the FIFO waits for a writer; open one to let the walk
+		// go before failing.
+		if w, err := os.OpenFile(filepath.Join(dir, "pipe"), os.O_WRONLY, 0); err == nil {
+			w.Close()
+		}
+		t.Fatal("the walk blocked on a FIFO")
+	}
+
+	// A FIFO asked for directly isn't opened either.
+	if md := walk(t, os.DirFS(dir), "pipe", DefaultOptions()); md.Type != "pipe" {
+		t.Errorf("walking the FIFO itself: type %q", md.Type)
+	}
+}
+
+func TestWalkRetriesTransientErrors(t *testing.T) {
+	fsys := &faultyFS{
+		fsys: fstest.MapFS{"a.txt": file("aaaa"), "d/b.txt": file("bb"), "flaky.txt": file("flaky")},
+		err: syscall.ESTALE,
+		fail: map[string]int{"open a.txt": 2, "readdir d": 2, "lstat flaky.txt": 2},
+	}
+	opts := DefaultOptions()
+	opts.Retries = 3
+	opts.RetryBackoff = time.Millisecond
+	md := walk(t, fsys, ".", opts)
+	for _, p := range []string{"a.txt", "d/b.txt", "flaky.txt"} {
+		if f := find(&md, p); f == nil || f.Error != "" || f.FileSize == 0 {
+			t.Errorf("%s: got %+v, want it listed once the retries got through", p, f)
+		}
+	}
+	for _, key := range []string{"open a.txt", "readdir d", "lstat flaky.txt"} {
+		if n := fsys.calls[key]; n != 3 {
+			t.Errorf("%s: called %d times, want 2 failures and a success", key, n)
+		}
+	}
+
+	// With too few retries the error is recorded on the entry.
+	fsys = &faultyFS{fsys: fsys.fsys, err: syscall.ESTALE, fail: map[string]int{"open a.txt": -1}}
+	opts.Retries = 2
+	md = walk(t, fsys, ".", opts)
+	if f := find(&md, "a.txt"); f == nil || !strings.Contains(f.Error, "stale") {
+		t.Errorf("a.txt: got %+v, want a stale handle error", f)
+	}
+	if n := fsys.calls["open a.txt"]; n != 3 {
+		t.Errorf("opened %d times, want the first try and 2 retries", n)
+	}
+
+	// Errors that won't go away fail at once.
+	for _, err := range []error{fs.ErrPermission, syscall.EIO} {
+		fsys = &faultyFS{fsys: fsys.fsys, err: err, fail: map[string]int{"open a.txt": 1}}
+		md = walk(t, fsys, ".", opts)
+		if f := find(&md, "a.txt"); f == nil || f.Error == "" {
+			t.Errorf("%v: got %+v, want the error recorded", err, f)
+		}
+		if n := fsys.calls["open a.txt"]; n != 1 {
+			t.Errorf("%v: opened %d times, want no retries", err, n)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"example/josh/goserver/metadata"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gms_http_requests_total",
+		Help: "HTTP requests served, by status code.",
+	}, []string{"code"})
+
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "gms_http_request_duration_seconds",
+		Help: "Time taken to serve an HTTP request.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	walkEntries = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "gms_walk_entries",
+		Help: "Files, directories and links visited per metadata request.",
+		Buckets: prometheus.ExponentialBuckets(1, 10, 7),
+	})
+
+	walkGoroutines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gms_walk_goroutines_spawned_total",
+		Help: "Goroutines started to walk directory entries.",
+	})
+
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gms_http_requests_in_flight",
+		Help: "HTTP requests being served.",
+	})
+
+	walksInFlight = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gms_walks_in_flight",
+		Help: "Walks that have started and not yet finished.",
+	}, func() float64 { return float64(metadata.CurrentActivity().Walks) })
+
+	walkGoroutinesRunning = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gms_walk_goroutines_running",
+		Help: "Goroutines walking directory entries right now.",
+	}, func() float64 { return float64(metadata.CurrentActivity().Goroutines) })
+
+	walkGoroutinesPeak = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gms_walk_goroutines_peak",
+		Help: "Most goroutines that have walked directory entries at once since the process started.",
+	}, func() float64 { return float64(metadata.CurrentActivity().PeakGoroutines) })
+)
+
+// observeWalk records the counters collected by a single walk.
+func observeWalk(stats *metadata.Stats) {
+	walkEntries.Observe(float64(stats.Entries.Load()))
+	walkGoroutines.Add(float64(stats.Goroutines.Load()))
+}
+
+// metricsMiddleware counts requests by status and times them.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestsTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+		requestDuration.Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "aaaa", "d/b.txt": "bbbb", "d/e/c.txt": "cc"})
+	s := newTestServer(t, root)
+	h := gzipMiddleware(http.HandlerFunc(s.fileMetadataHandler))
+
+	plain := getWith(h.ServeHTTP, "/", nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("compressed without Accept-Encoding: %q", plain.Header().Get("Content-Encoding"))
+	}
+
+	w := getWith(h.ServeHTTP, "/", map[string]string{"Accept-Encoding": "br, gzip"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d with Content-Encoding %q, want 200 gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type %q, want application/json; charset=utf-8", ct)
+	}
+	if w.Header().Get("Vary") == "" {
+		t.Error("no Vary header on a compressed response")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading the gzip stream to its end: %v", err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("decompressed body differs from the uncompressed one:\n%s\n%s", body, plain.Body)
+	}
+
+	// A 304 has no body to compress.
+	nm := getWith(h.ServeHTTP, "/", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": plain.Header().Get("ETag")})
+	if nm.Code != http.StatusNotModified || nm.Header().Get("Content-Encoding") != "" || nm.Body.Len() != 0 {
+		t.Errorf("304: Content-Encoding %q with %d bytes, want neither", nm.Header().Get("Content-Encoding"), nm.Body.Len())
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"": false,
+		"identity": false,
+		"br": false,
+		"gzip": true,
+		"GZIP": true,
+		"br, gzip": true,
+		"gzip;q=0.5": true,
+		"gzip;q=0": false,
+		"gzip; q=0.0": false,
+		"*": true,
+		"deflate, *;q=0": false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := loggingMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short")
+	}))
+	get(h.ServeHTTP, "/some/path?q=1")
+
+	var line struct {
+		Level string `json:"level"`
+		Msg string `json:"msg"`
+		Method string `json:"method"`
+		Path string `json:"path"`
+		Status int `json:"status"`
+		Bytes int64 `json:"bytes"`
+		Duration *int64 `json:"duration"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("decoding log line %q: %v", buf.String(), err)
+	}
+	if line.Level != "INFO" || line.Msg != "request" || line.Method != http.MethodGet || line.Path != "/some/path" {
+		t.Errorf("logged %s %q for %s %s", line.Level, line.Msg, line.Method, line.Path)
+	}
+	if line.Status != http.StatusTeapot || line.Bytes != 5 || line.Duration == nil {
+		t.Errorf("logged status %d, %d bytes, duration %v; want 418, 5 and a duration", line.Status, line.Bytes, line.Duration)
+	}
+
+	if _, err := newLogger("xml", &buf); err == nil {
+		t.Error("newLogger accepted -log-format xml")
+	}
+}
+
+func TestWalkErrorIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("text", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	s := newTestServer(t, t.TempDir())
+	s.fsys = brokenFS{errors.New("disk on fire")}
+	decodeError(t, get(s.fileMetadataHandler, "/"), http.StatusInternalServerError)
+	if out := buf.String(); !strings.Contains(out, "level=ERROR") || !strings.Contains(out, "disk on fire") {
+		t.Errorf("log %q, want an error naming the cause", out)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("text", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := recoverMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["nil map"]++
+	}))
+	e := decodeError(t, get(h.ServeHTTP, "/"), http.StatusInternalServerError)
+	if e.Error != "Internal server error" {
+		t.Errorf("error %q", e.Error)
+	}
+	if out := buf.String(); !strings.Contains(out, "panic serving request") || !strings.Contains(out, "middleware_test.go") {
+		t.Errorf("log %q, want the panic and its stack", out)
+	}
+
+	// An aborted handler is left for net/http to drop the connection.
+	h = recoverMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+	}()
+	get(h.ServeHTTP, "/")
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	s := newTestServer(t, root)
+	const origin = "https://ui.example"
+	h := corsMiddleware(origin, http.HandlerFunc(s.fileMetadataHandler))
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	preflight := httptest.NewRecorder()
+	h.ServeHTTP(preflight, req)
+	if preflight.Code != http.StatusNoContent || preflight.Body.Len() != 0 {
+		t.Errorf("preflight: %d with %q, want 204 and no body", preflight.Code, preflight.Body)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin": origin,
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": "Authorization",
+		"Vary": "Origin",
+	} {
+		if got := preflight.Header().Get(header); got != want {
+			t.Errorf("preflight %s: %q, want %q", header, got, want)
+		}
+	}
+
+	w := getWith(h.ServeHTTP, "/", map[string]string{"Origin": origin})
+	decodeTree(t, w)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+		t.Errorf("GET Access-Control-Allow-Origin %q, want %q", got, origin)
+	}
+	if !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Errorf("ETag isn't exposed: %q", w.Header().Get("Access-Control-Expose-Headers"))
+	}
+
+	other := getWith(h.ServeHTTP, "/", map[string]string{"Origin": "https://elsewhere.example"})
+	if got := other.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("another origin was allowed: %q", got)
+	}
+	wildcard := getWith(corsMiddleware("*", http.HandlerFunc(s.fileMetadataHandler)).ServeHTTP, "/", map[string]string{"Origin": "https://elsewhere.example"})
+	if got := wildcard.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("with -cors-origin *: Access-Control-Allow-Origin %q", got)
+	}
+}
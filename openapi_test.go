@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	w := get(openAPIHandler, "/openapi.json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths map[string]struct {
+			Get struct {
+				Parameters []struct {
+					Ref string `json:"$ref"`
+				} `json:"parameters"`
+			} `json:"get"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+			Parameters map[string]struct {
+				Name string `json:"name"`
+				In string `json:"in"`
+			} `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("spec doesn't parse: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi %q, want 3.x", spec.OpenAPI)
+	}
+
+	schema, ok := spec.Components.Schemas["FileMetadata"]
+	if !ok {
+		t.Fatal("no FileMetadata schema")
+	}
+	for name := range metadataFields {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("FileMetadata schema is missing %s", name)
+		}
+	}
+	for name := range schema.Properties {
+		if !metadataFields[name] {
+			t.Errorf("FileMetadata schema describes %s, which FileMetadata doesn't have", name)
+		}
+	}
+
+	// The metadata endpoint documents exactly the parameters it accepts.
+	documented := map[string]bool{}
+	for _, p := range spec.Paths["/"].Get.Parameters {
+		param := spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+		if param.In != "query" {
+			t.Errorf("%s: not a query parameter", p.Ref)
+		}
+		documented[param.Name] = true
+	}
+	for name := range queryParams {
+		if !documented[name] {
+			t.Errorf("query parameter %s is undocumented", name)
+		}
+	}
+	for name := range documented {
+		if !queryParams[name] {
+			t.Errorf("documented parameter %s isn't accepted", name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest(http.MethodPost, "/openapi.json", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: status %d, Allow %q; want 405 with GET, HEAD", w.Code, w.Header().Get("Allow"))
+	}
+}
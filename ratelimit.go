@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter hands out request tokens, from one bucket shared by every
+// client or from a bucket per client IP.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// shared is nil when each client gets its own bucket.
+	shared *rate.Limiter
+
+	mu sync.Mutex
+	clients map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter allows perSecond requests a second on average with bursts
+// of up to burst, or perSecond rounded up when burst is zero.
+func newRateLimiter(perSecond float64, burst int, perClient bool) *rateLimiter {
+	if burst == 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	l := &rateLimiter{limit: rate.Limit(perSecond), burst: burst}
+	if perClient {
+		l.clients = make(map[string]*clientBucket)
+	} else {
+		l.shared = rate.NewLimiter(l.limit, burst)
+	}
+	return l
+}
+
+// reserve takes a token for a request from client, returning how long it
+// would have had to wait for one if none was free. A request that has to
+// wait is refused, so its token is handed back.
+func (l *rateLimiter) reserve(client string, now time.Time) time.Duration {
+	limiter := l.shared
+	if limiter == nil {
+		limiter = l.bucket(client, now)
+	}
+	res := limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+func (l *rateLimiter) bucket(client string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket left alone long enough to refill is no different from a
+	// new one, so dropping it loses nothing and keeps the map from
+	// growing with every client ever seen.
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	if now.Sub(l.lastSweep) > refill {
+		for ip, b := range l.clients {
+			if now.Sub(b.lastSeen) > refill {
+				delete(l.clients, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+// clientIP is the address a request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitMiddleware answers 429 to requests over the limit, with a
+// Retry-After saying when one would be let through.
+func rateLimitMiddleware(l *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay := l.reserve(clientIP(r), time.Now()); delay > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(delay.Seconds())), 10))
+			writeError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
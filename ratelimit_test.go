@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// getFrom sends a GET for / to h from addr.
+func getFrom(h http.Handler, addr string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = addr
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := rateLimitMiddleware(newRateLimiter(1, 3, false), ok)
+
+	codes := map[int]int{}
+	var limited *httptest.ResponseRecorder
+	for range 10 {
+		w := getFrom(h, "192.0.2.1:1234")
+		codes[w.Code]++
+		if w.Code == http.StatusTooManyRequests {
+			limited = w
+		}
+	}
+	if codes[http.StatusOK] != 3 || codes[http.StatusTooManyRequests] != 7 {
+		t.Fatalf("codes %v, want the burst of 3 let through and the rest refused", codes)
+	}
+	if secs, err := strconv.Atoi(limited.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Errorf("Retry-After %q, want a whole number of seconds", limited.Header().Get("Retry-After"))
+	}
+	decodeError(t, limited, http.StatusTooManyRequests)
+	// The shared bucket refuses other clients as well.
+	if w := getFrom(h, "192.0.2.2:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("another client got %d from the shared bucket", w.Code)
+	}
+}
+
+func TestRateLimitPerClient(t *testing.T) {
+	l := newRateLimiter(1, 2, true)
+	h := rateLimitMiddleware(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 2 {
+		getFrom(h, "192.0.2.1:1")
+	}
+	if w := getFrom(h, "192.0.2.1:2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("third request from one client: %d, want 429", w.Code)
+	}
+	if w := getFrom(h, "192.0.2.2:1"); w.Code != http.StatusOK {
+		t.Errorf("another client: %d, want its own bucket", w.Code)
+	}
+
+	// Buckets idle long enough to have refilled are dropped.
+	now := time.Now()
+	l.reserve("192.0.2.3", now.Add(time.Hour))
+	if len(l.clients) != 1 {
+		t.Errorf("%d buckets after the others sat idle for an hour, want 1", len(l.clients))
+	}
+	// A refused request gives its token back.
+	l = newRateLimiter(1, 1, false)
+	if d := l.reserve("c", now); d != 0 {
+		t.Fatalf("first request waits %s", d)
+	}
+	for range 5 {
+		l.reserve("c", now)
+	}
+	if d := l.reserve("c", now.Add(time.Second)); d != 0 {
+		t.Errorf("a second later the request would wait %s; refused requests took tokens", d)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"path/filepath"
+
+	"example/josh/goserver/metadata"
+)
+
+// addRealPaths fills in the real path of m and of everything beneath it,
+// resolving every symlink from the served root on disk. An entry that
+// doesn't resolve, such as a dangling link, is left without one.
+func addRealPaths(m *metadata.FileMetadata, root string) {
+	if p, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(m.Path))); err == nil {
+		m.RealPath = p
+	}
+	for i := range m.Files {
+		addRealPaths(&m.Files[i], root)
+	}
+}
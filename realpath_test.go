@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRealPath(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"target.txt": "t", "d/x.txt": "x"})
+	for link, target := range map[string]string{"link": "target.txt", "dirlink": "d", "dangling": "missing"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The temporary directory may itself be reached through a link.
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, root)
+	s.followSymlinks = true
+
+	if w := get(s.fileMetadataHandler, "/"); strings.Contains(w.Body.String(), "real_path") {
+		t.Errorf("real_path reported without realpath=true:\n%s", w.Body)
+	}
+
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?realpath=true"))
+	for p, want := range map[string]string{
+		".": realRoot,
+		"target.txt": filepath.Join(realRoot, "target.txt"),
+		"link": filepath.Join(realRoot, "target.txt"),
+		"dirlink": filepath.Join(realRoot, "d"),
+		"dirlink/x.txt": filepath.Join(realRoot, "d", "x.txt"),
+		"d/x.txt": filepath.Join(realRoot, "d", "x.txt"),
+		"dangling": "",
+	} {
+		if got := findFile(t, md, p).RealPath; got != want {
+			t.Errorf("%s: real path %q, want %q", p, got, want)
+		}
+	}
+
+	// Flat and streamed listings carry it too.
+	w := get(s.fileMetadataHandler, "/link?realpath=true&format=ndjson")
+	var entry struct {
+		RealPath string `json:"real_path"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil || entry.RealPath != filepath.Join(realRoot, "target.txt") {
+		t.Errorf("ndjson: %s, %v", w.Body, err)
+	}
+	if found := decodeList(t, s.fileMetadataHandler, "/?search=x.txt&realpath=true"); len(found) != 2 || found[0].RealPath != found[1].RealPath {
+		t.Errorf("search: %+v, want d/x.txt and dirlink/x.txt resolving to the same file", found)
+	}
+
+	for _, query := range []string{"realpath=maybe", "realpath=true&format=csv", "realpath=true&format=summary"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen string
+	h := requestIDMiddleware(loggingMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+		logger.InfoContext(r.Context(), "inside")
+	})))
+
+	// A usable incoming ID is kept, in the response, the context and
+	// every line logged for the request.
+	w := getWith(h.ServeHTTP, "/", map[string]string{"X-Request-ID": "trace-123"})
+	if got := w.Header().Get("X-Request-ID"); got != "trace-123" || seen != "trace-123" {
+		t.Errorf("X-Request-ID %q and %q in the context, want trace-123 for both", got, seen)
+	}
+	lines := 0
+	for sc := bufio.NewScanner(&buf); sc.Scan(); lines++ {
+		var line struct {
+			Msg string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("decoding log line %q: %v", sc.Text(), err)
+		}
+		if line.RequestID != "trace-123" {
+			t.Errorf("%q logged with request_id %q, want trace-123", line.Msg, line.RequestID)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("%d log lines, want the handler's and the request's", lines)
+	}
+
+	// Without one, or with one that could forge log lines, a fresh UUID
+	// is made for each request.
+	ids := map[string]bool{}
+	for _, incoming := range []string{"", "forged\nlevel=ERROR", string(make([]byte, 200))} {
+		w := getWith(h.ServeHTTP, "/", map[string]string{"X-Request-ID": incoming})
+		id := w.Header().Get("X-Request-ID")
+		if !uuidPattern.MatchString(id) || id != seen {
+			t.Errorf("incoming %q: X-Request-ID %q and %q in the context, want the same UUID", incoming, id, seen)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("generated IDs %v, want three different ones", ids)
+	}
+
+	// Without the middleware there is no ID to log.
+	buf.Reset()
+	logger.Info("outside")
+	if bytes.Contains(buf.Bytes(), []byte("request_id")) {
+		t.Errorf("logged %q outside a request", buf.String())
+	}
+}
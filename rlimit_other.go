@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// defaultMaxOpenFiles returns fallback where there is no descriptor rlimit
+// to derive it from.
+func defaultMaxOpenFiles(fallback int) int { return fallback }
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"math"
+	"syscall"
+)
+
+// defaultMaxOpenFiles leaves half of the process's soft descriptor limit to
+// walks, keeping the rest for the listener, connections and logs. It
+// returns fallback if the limit can't be read or is too large to mean anything, as when it
+// is unlimited.
+func defaultMaxOpenFiles(fallback int) int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return fallback
+	}
+	if lim.Cur/2 > math.MaxInt32 {
+		return fallback
+	}
+	return max(int(lim.Cur/2), 1)
+}
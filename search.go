@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"example/josh/goserver/metadata"
+)
+
+// searchMatcher reports whether an entry's name matches a ?search term: a
+// glob when the term has any of *?[, and a substring otherwise.
+type searchMatcher struct {
+	term string
+	glob bool
+	ignoreCase bool
+}
+
+func newSearchMatcher(term string, ignoreCase bool) (searchMatcher, error) {
+	m := searchMatcher{term: term, glob: strings.ContainsAny(term, "*?["), ignoreCase: ignoreCase}
+	if ignoreCase {
+		m.term = strings.ToLower(term)
+	}
+	if m.glob {
+		if _, err := path.Match(m.term, ""); err != nil {
+			return m, fmt.Errorf("invalid search %q: %w", term, err)
+		}
+	}
+	return m, nil
+}
+
+func (m searchMatcher) matches(name string) bool {
+	if m.ignoreCase {
+		name = strings.ToLower(name)
+	}
+	if m.glob {
+		ok, _ := path.Match(m.term, name)
+		return ok
+	}
+	return strings.Contains(name, m.term)
+}
+
+// serveSearch walks name and answers with a flat list of the entries
+// beneath it whose names match the search, sorted by path, in place of
+// the tree. Each match is reshaped by fields and time-format as a node of
+// the tree would be.
+func (s *server) serveSearch(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, render renderOptions) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	matches := []metadata.FileMetadata{}
+	err := s.walkEntries(r, name, opts, func(e metadata.FileMetadata, _ bool) {
+		if e.Path != name && render.search.matches(e.Filename) {
+			matches = append(matches, e)
+		}
+	})
+	if err != nil {
+		writeWalkError(w, r, name, err)
+		return
+	}
+
+	slices.SortFunc(matches, func(a, b metadata.FileMetadata) int { return strings.Compare(a.Path, b.Path) })
+	for i := range matches {
+		if render.human != "" {
+			addHumanSizes(&matches[i], render.human == "si")
+		}
+		if render.realPath {
+			addRealPaths(&matches[i], s.root)
+		}
+	}
+	var body any = matches
+	if render.reshapes() {
+		reshaped := make([]map[string]any, len(matches))
+		for i := range matches {
+			if reshaped[i], err = reshape(matches[i], render); err != nil {
+				writeError(w, http.StatusInternalServerError, "Error generating JSON")
+				return
+			}
+		}
+		body = reshaped
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", render.indent)
+	if err := encoder.Encode(body); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating JSON")
+	}
+}
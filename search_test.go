@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"README.md": "top",
+		"a/b/c/d/Needle.txt": "deep",
+		"a/b/needle.go": "go",
+		"a/haystack.txt": "hay",
+		"needles/x.txt": "x",
+	})
+	s := newTestServer(t, root)
+
+	// Matches come flat, with their paths, however deep they are.
+	files := decodeList(t, s.fileMetadataHandler, "/?search=Needle.txt")
+	if got := paths(files); !slices.Equal(got, []string{"a/b/c/d/Needle.txt"}) {
+		t.Fatalf("search=Needle.txt found %q", got)
+	}
+	if f := files[0]; f.Filename != "Needle.txt" || f.FileSize != 4 || f.Files != nil {
+		t.Errorf("match %+v, want the file's own metadata", f)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want []string
+	}{
+		{"search=needle", []string{"a/b/needle.go", "needles"}},
+		{"search=needle&ignore-case=true", []string{"a/b/c/d/Needle.txt", "a/b/needle.go", "needles"}},
+		{"search=*.txt", []string{"a/b/c/d/Needle.txt", "a/haystack.txt", "needles/x.txt"}},
+		{"search=N*&ignore-case=false", []string{"a/b/c/d/Needle.txt"}},
+		{"search=N*&ignore-case=true", []string{"a/b/c/d/Needle.txt", "a/b/needle.go", "needles"}},
+		{"search=nothing", nil},
+	} {
+		if got := paths(decodeList(t, s.fileMetadataHandler, "/?"+tt.query)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s found %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	// Searching a subdirectory finds only what is beneath it, never the
+	// directory searched.
+	if got := paths(decodeList(t, s.fileMetadataHandler, "/a/b?search=b")); len(got) != 0 {
+		t.Errorf("search=b under a/b found %q", got)
+	}
+
+	// Matches are shaped like nodes of the tree.
+	w := get(s.fileMetadataHandler, "/?search=needle.go&fields=path,last_modified_date&time-format=unix")
+	var nodes []map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil || len(nodes) != 1 {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if _, ok := nodes[0]["last_modified_date"].(float64); !ok || len(nodes[0]) != 2 || nodes[0]["path"] != "a/b/needle.go" {
+		t.Errorf("reshaped match %v, want its path and a unix time", nodes[0])
+	}
+
+	for _, query := range []string{"search=[", "search=x&format=xml", "ignore-case=true", "search=x&ignore-case=maybe"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/json"
+	"compress/gzip"
+	"sort"
+	"encoding/xml"
+	"io"
+	"regexp"
+
+	"example/josh/goserver/metadata"
+)
+
+// queryParams are the query parameters the metadata handler understands.
+// Each is also described in openapi.json.
+var queryParams = map[string]bool{
+	"sort": true, "order": true, "depth": true, "checksum": true,
+	"compression": true, "level": true, "hidden": true, "gitignore": true,
+	"include": true, "exclude": true, "limit": true, "offset": true,
+	"min-size": true, "max-size": true, "modified-after": true, "modified-before": true,
+	"regex": true,
+	"format": true, "indent": true, "pretty": true, "human": true,
+	"fields": true, "time-format": true, "n": true, "by": true,
+	"search": true, "ignore-case": true, "dedupe": true, "gzip": true,
+	"realpath": true,
+}
+
+// parseOptions builds the walk and render settings for a request from the
+// server's configuration and the query string. An unknown parameter is an
+// error, so a typo isn't silently ignored.
+func (s *server) parseOptions(r *http.Request) (metadata.Options, renderOptions, error) {
+	var unknown []string
+	for key := range r.URL.Query() {
+		if !queryParams[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return metadata.Options{}, renderOptions{}, fmt.Errorf("unknown query parameter %q", unknown[0])
+	}
+
+	opts, err := parseWalkOptions(r, s.gzipLevel)
+	if err != nil {
+		return opts, renderOptions{}, err
+	}
+	render, err := parseRenderOptions(r)
+	if err != nil {
+		return opts, render, err
+	}
+	render.listingOnly = s.noGzip
+	if v := r.URL.Query().Get("gzip"); v != "" {
+		measure, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, render, fmt.Errorf("invalid gzip %q: must be true or false", v)
+		}
+		render.listingOnly = !measure
+	}
+	if render.listingOnly && render.topBy == "gzipped" {
+		return opts, render, fmt.Errorf("by=gzipped needs the gzip sizes that gzip=false leaves out")
+	}
+	if render.topBy == "gzipped" && opts.Compression != "" && opts.Compression != "gzip" {
+		return opts, render, fmt.Errorf("by=gzipped needs gzip sizes, not %s", opts.Compression)
+	}
+	// Streamed entries go out as they are walked, before any page could
+	// be cut from the sorted listing.
+	switch render.format {
+	case "ndjson", "csv", "summary", "top":
+		if opts.Offset > 0 || opts.Limit > 0 {
+			return opts, render, fmt.Errorf("offset and limit are not supported with the %s format", render.format)
+		}
+	}
+	if render.searching && (opts.Offset > 0 || opts.Limit > 0) {
+		return opts, render, fmt.Errorf("offset and limit are not supported with search")
+	}
+
+	// A HEAD response has no body, so the gzip sizes would be thrown away.
+	opts.SkipGzip = render.listingOnly || r.Method == http.MethodHead
+	s.applyWalkSettings(&opts)
+	return opts, render, nil
+}
+
+// applyWalkSettings copies the server's configured limits and shared
+// state into opts, which no request can override.
+func (s *server) applyWalkSettings(opts *metadata.Options) {
+	opts.FollowSymlinks = s.followSymlinks
+	opts.OneFilesystem = s.oneFilesystem
+	opts.Limiter = s.limiter
+	opts.Workers = s.workers
+	opts.Cache = s.cache
+	opts.MaxCompressBytes = s.maxCompressBytes
+	opts.CompressTimeout = s.compressTimeout
+	opts.MaxDepth = s.maxDepth
+	opts.MaxEntries = s.maxEntries
+	opts.Retries = s.ioRetries
+	opts.RetryBackoff = s.ioRetryBackoff
+	opts.Stats = &metadata.Stats{}
+}
+
+// parseWalkOptions reads the walk settings from the query string, starting
+// from the server's default gzip level.
+func parseWalkOptions(r *http.Request, gzipLevel int) (metadata.Options, error) {
+	q := r.URL.Query()
+	opts := metadata.DefaultOptions()
+	opts.GzipLevel = gzipLevel
+
+	if v := q.Get("sort"); v != "" {
+		opts.SortBy = v
+	}
+
+	switch v := q.Get("order"); v {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("invalid order %q: must be asc or desc", v)
+	}
+
+	opts.Checksum = q.Get("checksum")
+
+	opts.Compression = q.Get("compression")
+
+	if v := q.Get("level"); v != "" {
+		level, err := parseGzipLevel(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.GzipLevel = level
+	}
+
+	for key, dst := range map[string]*int{"offset": &opts.Offset, "limit": &opts.Limit} {
+		if v := q.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid %s %q: must be a non-negative integer", key, v)
+			}
+			*dst = n
+		}
+	}
+
+	if v := q.Get("depth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 0 {
+			return opts, fmt.Errorf("invalid depth %q: must be a non-negative integer", v)
+		}
+		opts.Depth = depth
+	}
+
+	if v := q.Get("hidden"); v != "" {
+		hidden, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid hidden %q: must be true or false", v)
+		}
+		opts.SkipHidden = !hidden
+	}
+
+	if v := q.Get("gitignore"); v != "" {
+		gitignore, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid gitignore %q: must be true or false", v)
+		}
+		opts.Gitignore = gitignore
+	}
+
+	for key, dst := range map[string]*int64{"min-size": &opts.MinSize, "max-size": &opts.MaxSize} {
+		if v := q.Get(key); v != "" {
+			n, err := parseByteSize(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = n
+		}
+	}
+
+	now := time.Now()
+	for key, dst := range map[string]*time.Time{"modified-after": &opts.ModifiedAfter, "modified-before": &opts.ModifiedBefore} {
+		if v := q.Get(key); v != "" {
+			t, err := parseTimeOrOffset(v, now)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = t
+		}
+	}
+
+	if v := q.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid regex: %w", err)
+		}
+		opts.Regexp = re
+	}
+
+	opts.Include = splitList(q.Get("include"))
+	opts.Exclude = splitList(q.Get("exclude"))
+
+	return opts, opts.Validate()
+}
+
+// parseGzipLevel accepts a compression level from 1 to 9 or one of the
+// names default, best-speed and best-compression.
+func parseGzipLevel(v string) (int, error) {
+	switch v {
+	case "default":
+		return gzip.DefaultCompression, nil
+	case "best-speed":
+		return gzip.BestSpeed, nil
+	case "best-compression":
+		return gzip.BestCompression, nil
+	}
+	level, err := strconv.Atoi(v)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid gzip level %q: must be 1 to 9, default, best-speed or best-compression", v)
+	}
+	return level, nil
+}
+
+// parseTimeOrOffset reads an RFC 3339 timestamp, or a duration such as
+// "-24h" taken relative to now.
+func parseTimeOrOffset(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want an RFC 3339 timestamp or a duration such as -24h", v)
+}
+
+// splitList splits a comma-separated query value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// renderOptions control how a response body is written.
+type renderOptions struct {
+	// format is "json", "xml" or "tree" (drawn like the tree command) for
+	// the nested tree, "ndjson" or "csv" to stream one entry per line or
+	// "summary" for totals only, or "top" for a flat list of the largest
+	// files.
+	format string
+	// indent is the per-level JSON indentation; "" writes compact JSON.
+	indent string
+	// human adds human-readable sizes when set, in "iec" or "si" units.
+	human string
+	// fields, if not nil, limits each node to these JSON fields.
+	fields map[string]bool
+	// timeFormat is "unix" or "unixmilli" to write timestamps as numbers,
+	// or "" for RFC 3339.
+	timeFormat string
+	// top is how many files ?format=top lists, ranked by topBy: "size"
+	// or "gzipped".
+	top int
+	topBy string
+	// search, when searching is set, picks the entries listed flat in
+	// place of the tree.
+	search searchMatcher
+	searching bool
+	// dedupe counts each hard-linked file once in ?format=summary.
+	dedupe bool
+	// listingOnly leaves out compressed sizes, skipping the slow part of
+	// the walk, as ?gzip=false or -no-gzip ask.
+	listingOnly bool
+	// realPath fills in each entry's path with symlinks resolved.
+	realPath bool
+}
+
+// maxIndent caps ?indent so a client can't make us pad every line with
+// an enormous string.
+const maxIndent = 8
+
+// parseRenderOptions reads the output settings from the query string.
+// Output is pretty-printed with two spaces unless ?pretty=false; ?indent
+// takes a number of spaces or "tab".
+func parseRenderOptions(r *http.Request) (renderOptions, error) {
+	q := r.URL.Query()
+	opts := renderOptions{format: "json", indent: "  ", top: defaultTop, topBy: "size"}
+
+	switch v := q.Get("format"); v {
+	case "":
+		if f := acceptedFormat(r.Header.Get("Accept")); f != "" {
+			opts.format = f
+		}
+	case "json":
+	case "xml", "tree", "ndjson", "csv", "summary", "top":
+		opts.format = v
+	default:
+		return opts, fmt.Errorf("invalid format %q: must be json, xml, tree, ndjson, csv, summary or top", v)
+	}
+
+	if q.Has("n") || q.Has("by") {
+		if opts.format != "top" {
+			return opts, fmt.Errorf("n and by are only supported with the top format")
+		}
+	}
+	if v := q.Get("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTop {
+			return opts, fmt.Errorf("invalid n %q: must be a number from 1 to %d", v, maxTop)
+		}
+		opts.top = n
+	}
+	switch v := q.Get("by"); v {
+	case "", "size":
+	case "gzipped":
+		opts.topBy = v
+	default:
+		return opts, fmt.Errorf("invalid by %q: must be size or gzipped", v)
+	}
+
+	if v := q.Get("dedupe"); v != "" {
+		if opts.format != "summary" {
+			return opts, fmt.Errorf("dedupe is only supported with the summary format")
+		}
+		dedupe, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid dedupe %q: must be true or false", v)
+		}
+		opts.dedupe = dedupe
+	}
+
+	if v := q.Get("realpath"); v != "" {
+		switch opts.format {
+		case "tree", "csv", "summary":
+			return opts, fmt.Errorf("realpath is not supported with the %s format", opts.format)
+		}
+		realPath, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid realpath %q: must be true or false", v)
+		}
+		opts.realPath = realPath
+	}
+
+	if v := q.Get("indent"); v != "" {
+		if v == "tab" {
+			opts.indent = "\t"
+		} else {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxIndent {
+				return opts, fmt.Errorf("invalid indent %q: must be tab or a number of spaces from 0 to %d", v, maxIndent)
+			}
+			opts.indent = strings.Repeat(" ", n)
+		}
+	}
+
+	switch v := q.Get("human"); v {
+	case "", "false":
+	case "true", "iec":
+		opts.human = "iec"
+	case "si":
+		opts.human = v
+	default:
+		return opts, fmt.Errorf("invalid human %q: must be true, false, iec or si", v)
+	}
+
+	switch v := q.Get("time-format"); v {
+	case "", "rfc3339":
+	case "unix", "unixmilli":
+		if opts.format != "json" && opts.format != "ndjson" && opts.format != "csv" {
+			return opts, fmt.Errorf("time-format is only supported with the json, ndjson and csv formats")
+		}
+		opts.timeFormat = v
+	default:
+		return opts, fmt.Errorf("invalid time-format %q: must be rfc3339, unix or unixmilli", v)
+	}
+
+	ignoreCase := false
+	if v := q.Get("ignore-case"); v != "" {
+		var err error
+		if ignoreCase, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("invalid ignore-case %q: must be true or false", v)
+		}
+	}
+	if v := q.Get("search"); v != "" {
+		if opts.format != "json" {
+			return opts, fmt.Errorf("search is only supported with the json format")
+		}
+		m, err := newSearchMatcher(v, ignoreCase)
+		if err != nil {
+			return opts, err
+		}
+		opts.search, opts.searching = m, true
+	} else if q.Has("ignore-case") {
+		return opts, fmt.Errorf("ignore-case is only supported with search")
+	}
+
+	if v := q.Get("fields"); v != "" {
+		if opts.format != "json" && opts.format != "ndjson" {
+			return opts, fmt.Errorf("fields is only supported with the json and ndjson formats")
+		}
+		fields, err := parseFields(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.fields = fields
+	}
+
+	if v := q.Get("pretty"); v != "" {
+		pretty, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid pretty %q: must be true or false", v)
+		}
+		if !pretty {
+			opts.indent = ""
+		}
+	}
+
+	return opts, nil
+}
+
+// acceptedFormat picks a format from the first media type in an Accept
+// header, or returns "" to keep the JSON default. Browsers list HTML first,
+// so they keep getting JSON.
+func acceptedFormat(accept string) string {
+	first, _, _ := strings.Cut(accept, ",")
+	mediaType, _, _ := strings.Cut(first, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/xml", "text/xml":
+		return "xml"
+	case "text/plain":
+		return "tree"
+	}
+	return ""
+}
+
+// treeETag derives a weak ETag from the walk options, how the tree is to
+// be rendered, and each node's name, mtime, raw size and mode. Gzipped
+// sizes are left out so that HEAD, which skips compression, reports the
+// same tag as GET; render.listingOnly stands in for them, since a listing
+// without sizes is a different representation. So do the format and the
+// other rendering options, or an XML response could be revalidated
+// against a JSON one under Vary: Accept.
+func treeETag(m metadata.FileMetadata, opts metadata.Options, render renderOptions) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%t\x00%d\x00%s\x00%s\x00%d\x00%t\x00", opts.SortBy, opts.Descending, opts.Depth, opts.Checksum, opts.Compression, opts.GzipLevel, render.listingOnly)
+	fields := make([]string, 0, len(render.fields))
+	for f := range render.fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	fmt.Fprintf(h, "%s\x00%q\x00%s\x00%t\x00%q\x00%s\x00%t\x00", render.format, render.indent, render.human, render.fields != nil, fields, render.timeFormat, render.realPath)
+	hashTree(h, m)
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+func hashTree(h hash.Hash, m metadata.FileMetadata) {
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%s\x00%t\x00%s\x00%d\x00", m.Filename, m.LastModifiedDate.UnixNano(), m.FileSize, m.Mode, m.Error, m.Truncated, m.LinkTarget, len(m.Files))
+	for _, f := range m.Files {
+		hashTree(h, f)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 requires for that header.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// latestModTime is the newest mtime anywhere in the tree rooted at m.
+func latestModTime(m metadata.FileMetadata) time.Time {
+	latest := m.LastModifiedDate
+	for _, f := range m.Files {
+		if t := latestModTime(f); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// notModifiedSince reports whether an If-Modified-Since header is at or
+// after modTime, at the one-second resolution of HTTP dates.
+func notModifiedSince(header string, modTime time.Time) bool {
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+var errOutsideRoot = errors.New("path is outside the served root")
+
+// resolvePath joins the request path onto root and makes sure the result,
+// after resolving any symlinks, still lives underneath root. It returns the
+// path as a name within os.DirFS(root).
+func resolvePath(root, requestPath string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+requestPath)))
+	if !within(root, path) {
+		return "", errOutsideRoot
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, realPath) {
+		return "", errOutsideRoot
+	}
+
+	name, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(name), nil
+}
+
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// server holds the state shared by every request.
+type server struct {
+	root string
+	// fsys opens every file under openFiles' tokens.
+	fsys fs.FS
+	openFiles metadata.Limiter
+	limiter metadata.Limiter
+	// workers is nil when walks start a goroutine for every entry.
+	workers metadata.Limiter
+	// cache is nil when caching is disabled.
+	cache *metadata.Cache
+	// gzipLevel is used unless a request asks for another.
+	gzipLevel int
+	// noGzip skips compressed sizes unless a request asks for ?gzip=true.
+	noGzip bool
+	maxCompressBytes int64
+	compressTimeout time.Duration
+	maxDepth int
+	maxEntries int64
+	ioRetries int
+	ioRetryBackoff time.Duration
+	// cacheControl is sent with successful metadata responses, or is
+	// empty to send none.
+	cacheControl string
+	// requestTimeout bounds each walk; zero means no limit.
+	requestTimeout time.Duration
+	followSymlinks bool
+	oneFilesystem bool
+}
+
+// healthzHandler is a liveness check. It never touches the filesystem, so it
+// stays cheap and answers even if the served root has gone away.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// readyzHandler is a readiness check: it answers 503 unless the root can
+// still be opened and listed, so traffic isn't sent to an instance whose
+// volume has gone away or failed to mount.
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.checkRoot(); err != nil {
+		slog.WarnContext(r.Context(), "root is not accessible", "root", s.root, "err", err)
+		writeError(w, http.StatusServiceUnavailable, "Root directory is not accessible")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// checkRoot reads one entry of the root directory, which fails if it is
+// missing, no longer a directory, or unreadable.
+func (s *server) checkRoot() error {
+	dir, err := os.Open(s.root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.ReadDir(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+	Code int `json:"code"`
+}
+
+// writeError answers with status and a JSON body carrying msg, in place
+// of http.Error's plain text. Errors are never cached, whatever
+// Cache-Control a handler had set for success.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: msg, Code: status})
+}
+
+// writeWalkError answers a request whose walk failed at the requested path.
+func writeWalkError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The client has gone away; there is no one to respond to.
+		return
+	}
+	status, msg := walkErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "walking tree", "path", name, "err", err)
+	}
+	writeError(w, status, msg)
+}
+
+// walkErrorStatus is the status and message a failed walk is answered with.
+func walkErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, "Timed out walking the tree"
+	case errors.Is(err, metadata.ErrTooManyEntries):
+		return http.StatusRequestEntityTooLarge, "Too many entries to list; ask for less with depth or a subdirectory"
+	case os.IsNotExist(err):
+		return http.StatusNotFound, "File not found"
+	}
+	return http.StatusInternalServerError, "Error reading file"
+}
+
+// writeResolveError answers a request whose path resolvePath refused.
+func writeResolveError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errOutsideRoot) {
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	slog.ErrorContext(r.Context(), "resolving request path", "path", r.URL.Path, "err", err)
+	writeError(w, http.StatusInternalServerError, "Error reading file")
+}
+
+func (s *server) fileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// The representation can be chosen by Accept as well as ?format.
+	w.Header().Add("Vary", "Accept")
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+	opts, render, err := s.parseOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name, err := resolvePath(s.root, r.URL.Path)
+	if err != nil {
+		writeResolveError(w, r, err)
+		return
+	}
+
+	if render.searching {
+		s.serveSearch(w, r, name, opts, render)
+		return
+	}
+	switch render.format {
+	case "ndjson":
+		s.streamNDJSON(w, r, name, opts, render)
+		return
+	case "csv":
+		s.streamCSV(w, r, name, opts, render)
+		return
+	case "summary":
+		s.serveSummary(w, r, name, opts, render)
+		return
+	case "top":
+		s.serveTop(w, r, name, opts, render)
+		return
+	}
+
+	md, err := metadata.Walk(r.Context(), s.fsys, name, opts)
+	observeWalk(opts.Stats)
+	if err != nil {
+		writeWalkError(w, r, name, err)
+		return
+	}
+	// The root of an fs.FS is always called "."; report the directory's
+	// real name as before.
+	if name == "." {
+		md.Filename = filepath.Base(s.root)
+	}
+	if render.human != "" {
+		addHumanSizes(&md, render.human == "si")
+	}
+	if render.realPath {
+		addRealPaths(&md, s.root)
+	}
+
+	etag := treeETag(md, opts, render)
+	modTime := latestModTime(md)
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	// If-Modified-Since is only consulted when there is no If-None-Match.
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && notModifiedSince(ims, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	switch render.format {
+	case "xml":
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	case "tree":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if r.Method == http.MethodHead {
+		// Without the gzip pass the body would not match a GET, so don't
+		// let net/http derive a Content-Length from it.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// The tree and XML bodies go out as they are written, like the JSON
+	// one below, so a failure part way through can only be logged.
+	if render.format == "tree" {
+		if err := writeTree(w, md); err != nil {
+			slog.WarnContext(r.Context(), "writing text tree", "path", name, "err", err)
+		}
+		return
+	}
+	if render.format == "xml" {
+		io.WriteString(w, xml.Header)
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", render.indent)
+		if err := encoder.EncodeElement(md, xml.StartElement{Name: xml.Name{Local: "file"}}); err != nil {
+			slog.WarnContext(r.Context(), "writing XML tree", "path", name, "err", err)
+			return
+		}
+		io.WriteString(w, "\n")
+		return
+	}
+
+	if !render.reshapes() {
+		// The body goes out as it is encoded, so a failure part way
+		// through can only be logged.
+		if err := writeTreeJSON(w, md, render.indent); err != nil {
+			slog.WarnContext(r.Context(), "writing JSON tree", "path", name, "err", err)
+		}
+		return
+	}
+	body, err := reshape(md, render)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating JSON")
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", render.indent)
+	if err := encoder.Encode(body); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating JSON")
+	}
+}
+
@@ -0,0 +1,1237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"example/josh/goserver/metadata"
+)
+
+// newTestServer serves root with the settings main uses by default.
+func newTestServer(t *testing.T, root string) *server {
+	t.Helper()
+	openFiles := metadata.NewLimiter(64)
+	return &server{
+		root: root,
+		fsys: metadata.LimitOpenFiles(os.DirFS(root), openFiles),
+		openFiles: openFiles,
+		limiter: metadata.NewLimiter(metadata.DefaultMaxConcurrency),
+		gzipLevel: gzip.DefaultCompression,
+		maxDepth: metadata.DefaultMaxDepth,
+	}
+}
+
+// writeFiles creates each named file under dir, with its parents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// get sends a GET for target straight to h.
+func get(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+// decodeTree decodes a JSON metadata response, failing unless it is a 200.
+func decodeTree(t *testing.T, w *httptest.ResponseRecorder) metadata.FileMetadata {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	var md metadata.FileMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return md
+}
+
+// decodeError decodes an error response, failing unless its status is want.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder, want int) apiError {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status %d, want %d: %s", w.Code, want, w.Body)
+	}
+	var e apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if e.Code != want {
+		t.Errorf("error code %d, want %d", e.Code, want)
+	}
+	return e
+}
+
+func TestResolvePath(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{"secret": "s", "root/a/b.txt": "b", "root/secret": "inside"})
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", filepath.Join(root, "a", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b.txt", filepath.Join(root, "a", "in")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		err error
+	}{
+		{"/", ".", nil},
+		{"/a/b.txt", "a/b.txt", nil},
+		{"/a/./b.txt", "a/b.txt", nil},
+		{"/a/in", "a/in", nil},
+		// Climbing out is clamped at the root, as a browser would.
+		{"/../secret", "secret", nil},
+		{"/a/../../../secret", "secret", nil},
+		{"/..", ".", nil},
+		// An absolute path is still taken within the root.
+		{parent + "/secret", "", os.ErrNotExist},
+		{"//secret", "secret", nil},
+		// Links that lead out of the root are refused.
+		{"/out", "", errOutsideRoot},
+		{"/a/up", "", errOutsideRoot},
+		{"/a/up/secret", "", errOutsideRoot},
+		{"/missing", "", os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		got, err := resolvePath(root, tt.path)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("resolvePath(%q) error = %v, want %v", tt.path, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolvePath(%q) = %q, %v; want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestTraversalStaysInRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{"secret": "outside", "root/a.txt": "a"})
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(parent, filepath.Join(root, "outdir")); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, root)
+
+	for _, target := range []string{
+		"/../secret",
+		"/%2e%2e/secret",
+		"/%2E%2E%2Fsecret",
+		"/..%2fsecret",
+		"/a.txt/../../secret",
+	} {
+		// Each resolves to root/secret, which doesn't exist.
+		decodeError(t, get(s.fileMetadataHandler, target), http.StatusNotFound)
+	}
+	for _, target := range []string{"/out", "/outdir", "/outdir/secret", "/download/out", "/archive/outdir"} {
+		h := s.fileMetadataHandler
+		switch {
+		case strings.HasPrefix(target, "/download/"):
+			h = s.downloadHandler
+		case strings.HasPrefix(target, "/archive/"):
+			h = s.archiveHandler
+		}
+		decodeError(t, get(h, target), http.StatusForbidden)
+	}
+}
+
+// brokenFS fails every call with err.
+type brokenFS struct{ err error }
+
+func (b brokenFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: b.err}
+}
+
+func TestInternalErrorHasOnlyErrorBody(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.fsys = brokenFS{errors.New("disk on fire")}
+	w := get(s.fileMetadataHandler, "/")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", w.Code)
+	}
+	if got, want := w.Body.String(), `{"error":"Error reading file","code":500}`+"\n"; got != want {
+		t.Errorf("body %q, want exactly %q", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type %q, want application/json; charset=utf-8", ct)
+	}
+}
+
+func TestNotFoundHasOnlyErrorBody(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	w := get(s.fileMetadataHandler, "/missing")
+	if got, want := w.Body.String(), `{"error":"File not found","code":404}`+"\n"; w.Code != http.StatusNotFound || got != want {
+		t.Errorf("got %d %q, want 404 %q", w.Code, got, want)
+	}
+}
+
+func TestListingOnly(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": strings.Repeat("a", 1000), "d/b.txt": "bb", "d/e/c.txt": "c"})
+	s := newTestServer(t, root)
+	full := decodeTree(t, get(s.fileMetadataHandler, "/"))
+	counter := &openCounter{fsys: s.fsys}
+	s.fsys = counter
+
+	// No file is opened, so none can be compressed, yet every entry is
+	// listed with its size and mtime.
+	check := func(name string, md metadata.FileMetadata) {
+		t.Helper()
+		if n := counter.opens.Swap(0); n != 0 {
+			t.Errorf("%s: opened %d files, want none", name, n)
+		}
+		if got, want := fileNames(md), fileNames(full); !slices.Equal(got, want) {
+			t.Errorf("%s: files %q, want %q", name, got, want)
+		}
+		for _, p := range []string{".", "a.txt", "d", "d/b.txt", "d/e/c.txt"} {
+			got, want := findFile(t, md, p), findFile(t, full, p)
+			if got.FileSize != want.FileSize || !got.LastModifiedDate.Equal(want.LastModifiedDate) {
+				t.Errorf("%s: %s listed as %+v", name, p, got)
+			}
+			if got.FileSizeGzipped != nil || got.CompressedSize != 0 {
+				t.Errorf("%s: %s has compressed sizes %v and %d", name, p, got.FileSizeGzipped, got.CompressedSize)
+			}
+		}
+	}
+	w := get(s.fileMetadataHandler, "/?gzip=false")
+	if strings.Contains(w.Body.String(), "file_size_gzipped") {
+		t.Errorf("gzip=false still encodes file_size_gzipped:\n%s", w.Body)
+	}
+	check("gzip=false", decodeTree(t, w))
+
+	// -no-gzip makes it the default, which a request can turn back.
+	s.noGzip = true
+	check("-no-gzip", decodeTree(t, get(s.fileMetadataHandler, "/")))
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/?gzip=true")); counter.opens.Swap(0) == 0 || md.FileSizeGzipped == nil {
+		t.Error("gzip=true under -no-gzip measured nothing")
+	}
+
+	if get(s.fileMetadataHandler, "/?gzip=false").Header().Get("ETag") == get(s.fileMetadataHandler, "/?gzip=true").Header().Get("ETag") {
+		t.Error("a listing and a measured tree share an ETag")
+	}
+	for _, query := range []string{"gzip=maybe", "gzip=false&format=top&by=gzipped"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	for _, tt := range []struct {
+		maxAge time.Duration
+		public bool
+		want string
+	}{
+		{0, false, ""},
+		{time.Minute, false, "private, max-age=60"},
+		{90*time.Second + 500*time.Millisecond, true, "public, max-age=90"},
+	} {
+		if got := cacheControl(tt.maxAge, tt.public); got != tt.want {
+			t.Errorf("cacheControl(%s, %t) = %q, want %q", tt.maxAge, tt.public, got, tt.want)
+		}
+	}
+
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	s := newTestServer(t, root)
+	if cc := get(s.fileMetadataHandler, "/").Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("Cache-Control %q without -cache-max-age, want none", cc)
+	}
+
+	s.cacheControl = cacheControl(time.Minute, true)
+	w := get(s.fileMetadataHandler, "/")
+	if cc := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || cc != "public, max-age=60" {
+		t.Errorf("200: Cache-Control %q, want public, max-age=60", cc)
+	}
+	// Revalidating with the ETag keeps the same lifetime.
+	nm := getWith(s.fileMetadataHandler, "/", map[string]string{"If-None-Match": w.Header().Get("ETag")})
+	if cc := nm.Header().Get("Cache-Control"); nm.Code != http.StatusNotModified || cc != "public, max-age=60" {
+		t.Errorf("304: status %d with Cache-Control %q", nm.Code, cc)
+	}
+	// Errors are never cached.
+	for _, target := range []string{"/missing", "/?depth=deep"} {
+		if cc := get(s.fileMetadataHandler, target).Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%s: Cache-Control %q, want no-store", target, cc)
+		}
+	}
+}
+
+func TestErrorsAreJSON(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{"secret": "outside", "root/a.txt": "a", "root/d/b.txt": "b"})
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, root)
+	broken := newTestServer(t, root)
+	broken.fsys = brokenFS{errors.New("disk on fire")}
+
+	for _, c := range []struct {
+		h http.HandlerFunc
+		target string
+		status int
+		msg string
+	}{
+		{s.fileMetadataHandler, "/missing", http.StatusNotFound, "File not found"},
+		{s.fileMetadataHandler, "/?depth=deep", http.StatusBadRequest, ""},
+		{s.fileMetadataHandler, "/out", http.StatusForbidden, "Forbidden"},
+		{broken.fileMetadataHandler, "/", http.StatusInternalServerError, "Error reading file"},
+		{s.downloadHandler, "/download/missing", http.StatusNotFound, "File not found"},
+		{s.downloadHandler, "/download/d", http.StatusBadRequest, ""},
+		{s.archiveHandler, "/archive/?format=rar", http.StatusBadRequest, `invalid format "rar": must be tar or zip`},
+	} {
+		w := get(c.h, c.target)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q, want application/json; charset=utf-8", c.target, ct)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%s: Cache-Control %q, want no-store", c.target, cc)
+		}
+		e := decodeError(t, w, c.status)
+		if e.Error == "" || c.msg != "" && e.Error != c.msg {
+			t.Errorf("%s: error %q, want %q", c.target, e.Error, c.msg)
+		}
+	}
+}
+
+func TestContentTypeIsJSON(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "dir/b.txt": "b"})
+	s := newTestServer(t, root)
+	for _, target := range []string{"/", "/a.txt", "/dir"} {
+		w := get(s.fileMetadataHandler, target)
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/json; charset=utf-8" {
+			t.Errorf("%s: %d with Content-Type %q, want 200 with application/json; charset=utf-8", target, w.Code, ct)
+		}
+	}
+}
+
+func TestServesRelativeToRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "served")
+	writeFiles(t, root, map[string]string{"a.txt": "aaa", "sub/b.txt": "bb"})
+	s := newTestServer(t, root)
+
+	md := decodeTree(t, get(s.fileMetadataHandler, "/"))
+	if md.Filename != "served" || md.Path != "." || len(md.Files) != 2 {
+		t.Errorf("root: filename %q, path %q, %d files; want served, ., 2", md.Filename, md.Path, len(md.Files))
+	}
+	md = decodeTree(t, get(s.fileMetadataHandler, "/sub/b.txt"))
+	if md.Filename != "b.txt" || md.Path != "sub/b.txt" || md.FileSize != 2 {
+		t.Errorf("sub/b.txt: filename %q, path %q, size %d; want b.txt, sub/b.txt, 2", md.Filename, md.Path, md.FileSize)
+	}
+}
+
+func TestSortParameters(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "aaaa", "b": "b", "c": "cc"})
+	s := newTestServer(t, root)
+
+	for target, want := range map[string][]string{
+		"/": {"a", "b", "c"},
+		"/?sort=name&order=desc": {"c", "b", "a"},
+		"/?sort=size": {"b", "c", "a"},
+		"/?sort=size&order=desc": {"a", "c", "b"},
+	} {
+		md := decodeTree(t, get(s.fileMetadataHandler, target))
+		var got []string
+		for _, f := range md.Files {
+			got = append(got, f.Filename)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: %q, want %q", target, got, want)
+		}
+	}
+	for _, target := range []string{"/?sort=colour", "/?order=sideways"} {
+		e := decodeError(t, get(s.fileMetadataHandler, target), http.StatusBadRequest)
+		if !strings.Contains(e.Error, "must be") {
+			t.Errorf("%s: error %q doesn't say what is allowed", target, e.Error)
+		}
+	}
+}
+
+func TestDepthParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"one/two/a.txt": "a"})
+	s := newTestServer(t, root)
+
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?depth=1"))
+	if len(md.Files) != 1 || !md.Files[0].Truncated || md.Files[0].Files != nil {
+		t.Errorf("depth 1: got %+v, want one truncated directory", md.Files)
+	}
+	for _, v := range []string{"-1", "x", "1.5"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?depth="+v), http.StatusBadRequest)
+	}
+}
+
+// openCounter counts the files opened through fsys. Listing, stat and
+// readlink calls are passed through uncounted.
+type openCounter struct {
+	fsys fs.FS
+	opens atomic.Int64
+}
+
+func (c *openCounter) Open(name string) (fs.File, error) {
+	c.opens.Add(1)
+	return c.fsys.Open(name)
+}
+
+func (c *openCounter) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(c.fsys, name) }
+func (c *openCounter) Stat(name string) (fs.FileInfo, error) { return fs.Stat(c.fsys, name) }
+func (c *openCounter) Lstat(name string) (fs.FileInfo, error) { return fs.Lstat(c.fsys, name) }
+func (c *openCounter) ReadLink(name string) (string, error) { return fs.ReadLink(c.fsys, name) }
+
+func TestHeadSkipsCompression(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": strings.Repeat("a", 1000), "d/b.txt": "b"})
+	s := newTestServer(t, root)
+	counter := &openCounter{fsys: s.fsys}
+	s.fsys = counter
+
+	w := httptest.NewRecorder()
+	s.fileMetadataHandler(w, httptest.NewRequest(http.MethodHead, "/", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: %d with %d bytes of body, want 200 and none", w.Code, w.Body.Len())
+	}
+	if n := counter.opens.Load(); n != 0 {
+		t.Errorf("HEAD opened %d files, want none", n)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("HEAD sent Content-Length %s, which a GET's body wouldn't match", cl)
+	}
+	if w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("HEAD Content-Type %q", w.Header().Get("Content-Type"))
+	}
+
+	g := get(s.fileMetadataHandler, "/")
+	if g.Header().Get("ETag") != w.Header().Get("ETag") {
+		t.Errorf("HEAD ETag %s, GET ETag %s; want them equal", w.Header().Get("ETag"), g.Header().Get("ETag"))
+	}
+	if counter.opens.Load() == 0 {
+		t.Error("GET opened no files, so the HEAD check proves nothing")
+	}
+}
+
+func TestRejectsOtherMethods(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	for _, h := range []http.HandlerFunc{s.fileMetadataHandler, s.downloadHandler, s.archiveHandler} {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(method, "/", nil))
+			decodeError(t, w, http.StatusMethodNotAllowed)
+			if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+				t.Errorf("%s: Allow %q, want GET, HEAD", method, allow)
+			}
+		}
+	}
+}
+
+// getWith sends a GET for target with the given request headers.
+func getWith(h http.HandlerFunc, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestETag(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "b"})
+	s := newTestServer(t, root)
+
+	first := get(s.fileMetadataHandler, "/")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("fresh GET: %d with ETag %q, want 200 and a weak ETag", first.Code, etag)
+	}
+	for _, inm := range []string{etag, strings.TrimPrefix(etag, "W/"), `"other", ` + etag, "*"} {
+		w := getWith(s.fileMetadataHandler, "/", map[string]string{"If-None-Match": inm})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: %d with %d bytes, want 304 and no body", inm, w.Code, w.Body.Len())
+		}
+	}
+	if w := getWith(s.fileMetadataHandler, "/", map[string]string{"If-None-Match": `W/"stale"`}); w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: %d, want 200", w.Code)
+	}
+
+	writeFiles(t, root, map[string]string{"d/b.txt": "changed"})
+	w := getWith(s.fileMetadataHandler, "/", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after a change: %d with ETag %s, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"old.txt": "o", "d/new.txt": "n"})
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{"old.txt": older, "d/new.txt": newer, "d": older, ".": older} {
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, root)
+
+	tests := []struct {
+		target string
+		modified time.Time
+	}{
+		{"/old.txt", older},
+		// A directory is as new as anything in it.
+		{"/d", newer},
+		{"/", newer},
+	}
+	for _, tt := range tests {
+		w := get(s.fileMetadataHandler, tt.target)
+		if got := w.Header().Get("Last-Modified"); got != tt.modified.Format(http.TimeFormat) {
+			t.Errorf("%s: Last-Modified %q, want %q", tt.target, got, tt.modified.Format(http.TimeFormat))
+		}
+		for since, want := range map[time.Time]int{
+			tt.modified: http.StatusNotModified,
+			tt.modified.Add(time.Hour): http.StatusNotModified,
+			tt.modified.Add(-time.Second): http.StatusOK,
+		} {
+			w := getWith(s.fileMetadataHandler, tt.target, map[string]string{"If-Modified-Since": since.Format(http.TimeFormat)})
+			if w.Code != want {
+				t.Errorf("%s since %s: %d, want %d", tt.target, since, w.Code, want)
+			}
+		}
+	}
+	// If-None-Match wins over If-Modified-Since.
+	w := getWith(s.fileMetadataHandler, "/old.txt", map[string]string{
+		"If-None-Match": `W/"stale"`,
+		"If-Modified-Since": newer.Format(http.TimeFormat),
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match with a later If-Modified-Since: %d, want 200", w.Code)
+	}
+}
+
+func TestChecksumParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"hello": "hello\n"})
+	s := newTestServer(t, root)
+	md := decodeTree(t, get(s.fileMetadataHandler, "/hello?checksum=md5"))
+	if md.Checksum != "b1946ac92492d2347c6235b4d2611184" || md.ChecksumAlgo != "md5" {
+		t.Errorf("checksum=md5: got %s %q", md.ChecksumAlgo, md.Checksum)
+	}
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/hello")); md.Checksum != "" {
+		t.Errorf("no checksum asked for, got %q", md.Checksum)
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/hello?checksum=sha1"), http.StatusBadRequest)
+}
+
+func TestHealthz(t *testing.T) {
+	// A directory named healthz at the top of the root is shadowed, and
+	// a file system that fails every call shows the check never walks.
+	s := newTestServer(t, t.TempDir())
+	s.fsys = brokenFS{errors.New("disk on fire")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/", s.fileMetadataHandler)
+
+	w := get(mux.ServeHTTP, "/healthz")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := w.Body.String(); got != `{"status":"ok"}`+"\n" {
+		t.Errorf("body %q", got)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+	decodeError(t, get(mux.ServeHTTP, "/"), http.StatusInternalServerError)
+}
+
+func TestReadyz(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	s := newTestServer(t, root)
+
+	// A root that never mounted isn't ready, though the process is live.
+	e := decodeError(t, get(s.readyzHandler, "/readyz"), http.StatusServiceUnavailable)
+	if e.Error != "Root directory is not accessible" {
+		t.Errorf("error %q", e.Error)
+	}
+	if w := get(healthzHandler, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz: status %d with the root missing, want 200", w.Code)
+	}
+
+	// Empty or not, a directory is ready.
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, files := range []map[string]string{nil, {"a.txt": "a"}} {
+		writeFiles(t, root, files)
+		w := get(s.readyzHandler, "/readyz")
+		if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}`+"\n" {
+			t.Errorf("%d files: got %d %q, want 200 ok", len(files), w.Code, w.Body)
+		}
+		if w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("Cache-Control %q, want no-store", w.Header().Get("Cache-Control"))
+		}
+	}
+
+	// Nor is a root that goes away, or is replaced by a file.
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	decodeError(t, get(s.readyzHandler, "/readyz"), http.StatusServiceUnavailable)
+	writeFiles(t, parent, map[string]string{"root": "a file"})
+	decodeError(t, get(s.readyzHandler, "/readyz"), http.StatusServiceUnavailable)
+}
+
+func TestMetrics(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "b"})
+	s := newTestServer(t, root)
+	h := metricsMiddleware(http.HandlerFunc(s.fileMetadataHandler))
+	decodeTree(t, get(h.ServeHTTP, "/"))
+
+	w := get(promhttp.Handler().ServeHTTP, "/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d scraping /metrics", w.Code)
+	}
+	for _, name := range []string{
+		"gms_http_requests_total",
+		"gms_http_request_duration_seconds",
+		"gms_walk_entries",
+		"gms_walk_goroutines_spawned_total",
+		"gms_http_requests_in_flight",
+		"gms_walks_in_flight",
+	} {
+		if !strings.Contains(w.Body.String(), "\n"+name) {
+			t.Errorf("no %s in the scrape", name)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `gms_http_requests_total{code="200"}`) {
+		t.Error("the request isn't counted under code 200")
+	}
+}
+
+func TestPrettyAndCompactJSON(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "bb", "d/e/c.txt": "ccc"})
+	s := newTestServer(t, root)
+
+	pretty := get(s.fileMetadataHandler, "/").Body.Bytes()
+	compact := get(s.fileMetadataHandler, "/?pretty=false").Body.Bytes()
+	if len(compact) >= len(pretty) {
+		t.Errorf("compact output is %d bytes, pretty %d", len(compact), len(pretty))
+	}
+	if !bytes.Contains(pretty, []byte("\n  \"")) {
+		t.Errorf("default output isn't indented by two spaces:\n%s", pretty)
+	}
+	if bytes.Count(compact, []byte("\n")) != 1 {
+		t.Errorf("compact output spans lines:\n%s", compact)
+	}
+	var want bytes.Buffer
+	if err := json.Compact(&want, pretty); err != nil {
+		t.Fatal(err)
+	}
+	want.WriteByte('\n')
+	if !bytes.Equal(compact, want.Bytes()) {
+		t.Errorf("compact output differs from the pretty one compacted:\n%s\n%s", compact, want.Bytes())
+	}
+	if zero := get(s.fileMetadataHandler, "/?indent=0").Body.Bytes(); !bytes.Equal(zero, compact) {
+		t.Errorf("indent=0 differs from pretty=false:\n%s", zero)
+	}
+
+	for query, indent := range map[string]string{"indent=tab": "\t", "indent=4": "    ", "indent=1": " "} {
+		var want bytes.Buffer
+		if err := json.Indent(&want, compact, "", indent); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(s.fileMetadataHandler, "/?"+query).Body.Bytes(); !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s:\n%s\nwant\n%s", query, got, want.Bytes())
+		}
+	}
+	for _, query := range []string{"pretty=maybe", "indent=9", "indent=-1", "indent=spaces"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
+
+// decodeLines decodes a 200 ndjson response into one entry per line.
+func decodeLines(t *testing.T, w *httptest.ResponseRecorder) []metadata.FileMetadata {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	var entries []metadata.FileMetadata
+	for line := range strings.Lines(w.Body.String()) {
+		var e metadata.FileMetadata
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("decoding line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestNDJSON(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{"a.txt": "a", "d/b.txt": "bb", "d/e/c.txt": "ccc", "d/e/f/g.txt": "gggg"}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+
+	w := get(s.fileMetadataHandler, "/?format=ndjson")
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if !w.Flushed {
+		t.Error("the stream was never flushed")
+	}
+	seen := map[string]metadata.FileMetadata{}
+	for _, e := range decodeLines(t, w) {
+		if _, ok := seen[e.Path]; ok {
+			t.Errorf("%s streamed twice", e.Path)
+		}
+		if len(e.Files) != 0 {
+			t.Errorf("%s streamed with its %d files nested", e.Path, len(e.Files))
+		}
+		seen[e.Path] = e
+	}
+	for name, data := range files {
+		if e, ok := seen[name]; !ok || e.Type != "file" || e.FileSize != int64(len(data)) {
+			t.Errorf("%s: streamed %+v, ok %t", name, e, ok)
+		}
+	}
+	for _, dir := range []string{".", "d", "d/e", "d/e/f"} {
+		if e, ok := seen[dir]; !ok || e.Type != "directory" {
+			t.Errorf("%s: streamed %+v, ok %t", dir, e, ok)
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("streamed %d entries, want 8", len(seen))
+	}
+	if root := seen["."]; root.FileSize != 10 || root.Filename != filepath.Base(s.root) {
+		t.Errorf("root record %q of %d bytes, want %q of 10", root.Filename, root.FileSize, filepath.Base(s.root))
+	}
+}
+
+func TestPathsAreRelativeToRoot(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"sub/dir/file.txt": "f", "top.txt": "t"})
+	s := newTestServer(t, root)
+
+	md := decodeTree(t, get(s.fileMetadataHandler, "/"))
+	if md.Path != "." {
+		t.Errorf("root path %q, want .", md.Path)
+	}
+	var paths []string
+	var collect func(metadata.FileMetadata)
+	collect = func(m metadata.FileMetadata) {
+		paths = append(paths, m.Path)
+		for _, f := range m.Files {
+			collect(f)
+		}
+	}
+	collect(md)
+	if want := []string{".", "sub", "sub/dir", "sub/dir/file.txt", "top.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("paths %q, want %q", paths, want)
+	}
+
+	// A subtree keeps the paths the whole tree gives it.
+	sub := decodeTree(t, get(s.fileMetadataHandler, "/sub/dir"))
+	if sub.Path != "sub/dir" || len(sub.Files) != 1 || sub.Files[0].Path != "sub/dir/file.txt" {
+		t.Errorf("/sub/dir: %q with %+v", sub.Path, sub.Files)
+	}
+	if f := decodeTree(t, get(s.fileMetadataHandler, "/sub/dir/file.txt")); f.Path != "sub/dir/file.txt" || f.Filename != "file.txt" {
+		t.Errorf("/sub/dir/file.txt: path %q, filename %q", f.Path, f.Filename)
+	}
+}
+
+func TestHiddenParameter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{".hidden": "h", ".git/HEAD": "ref", "d/.env": "e", "d/shown.txt": "s", "a.txt": "a"})
+	s := newTestServer(t, root)
+
+	paths := func(md metadata.FileMetadata) []string {
+		var out []string
+		var collect func(metadata.FileMetadata)
+		collect = func(m metadata.FileMetadata) {
+			out = append(out, m.Path)
+			for _, f := range m.Files {
+				collect(f)
+			}
+		}
+		collect(md)
+		return out
+	}
+	all := paths(decodeTree(t, get(s.fileMetadataHandler, "/")))
+	if want := []string{".", ".git", ".git/HEAD", ".hidden", "a.txt", "d", "d/.env", "d/shown.txt"}; !slices.Equal(all, want) {
+		t.Errorf("by default: %q, want %q", all, want)
+	}
+	if shown := paths(decodeTree(t, get(s.fileMetadataHandler, "/?hidden=true"))); !slices.Equal(shown, all) {
+		t.Errorf("hidden=true: %q, want everything", shown)
+	}
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?hidden=false"))
+	if got, want := paths(md), []string{".", "a.txt", "d", "d/shown.txt"}; !slices.Equal(got, want) {
+		t.Errorf("hidden=false: %q, want %q", got, want)
+	}
+	if md.FileSize != 2 || md.DirCount != 1 {
+		t.Errorf("hidden=false: %d bytes in %d directories, want 2 in 1", md.FileSize, md.DirCount)
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/?hidden=no-thanks"), http.StatusBadRequest)
+}
+
+func TestParseGzipLevel(t *testing.T) {
+	for v, want := range map[string]int{
+		"default": gzip.DefaultCompression,
+		"best-speed": gzip.BestSpeed,
+		"best-compression": gzip.BestCompression,
+		"1": 1,
+		"6": 6,
+		"9": 9,
+	} {
+		if got, err := parseGzipLevel(v); err != nil || got != want {
+			t.Errorf("parseGzipLevel(%q) = %d, %v; want %d", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "0", "10", "-1", "fast", "huffman-only"} {
+		if _, err := parseGzipLevel(v); err == nil {
+			t.Errorf("parseGzipLevel(%q) succeeded", v)
+		}
+	}
+}
+
+func TestLevelParameter(t *testing.T) {
+	root := t.TempDir()
+	var text strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&text, "record %d: value %d, checksum %x\n", i, i*i%977, i*7919)
+	}
+	writeFiles(t, root, map[string]string{"data.txt": text.String()})
+	s := newTestServer(t, root)
+
+	sizes := map[string]int64{}
+	for _, level := range []string{"1", "best-compression", "default"} {
+		md := decodeTree(t, get(s.fileMetadataHandler, "/data.txt?level="+level))
+		sizes[level] = *md.FileSizeGzipped
+	}
+	if !(sizes["1"] > sizes["default"] && sizes["default"] >= sizes["best-compression"]) {
+		t.Errorf("gzipped sizes by level %v, want level 1 largest and best-compression smallest", sizes)
+	}
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/data.txt")); *md.FileSizeGzipped != sizes["default"] {
+		t.Errorf("without ?level: %d, want the -gzip-level default's %d", *md.FileSizeGzipped, sizes["default"])
+	}
+	s.gzipLevel = gzip.BestSpeed
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/data.txt")); *md.FileSizeGzipped != sizes["1"] {
+		t.Errorf("with -gzip-level 1: %d, want %d", *md.FileSizeGzipped, sizes["1"])
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/data.txt?level=10"), http.StatusBadRequest)
+}
+
+func TestParseOptions(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	r := httptest.NewRequest(http.MethodGet, "/?sort=size&order=desc&depth=2&format=ndjson&hidden=false&include=*.go&level=9&checksum=md5", nil)
+	opts, render, err := s.parseOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.SortBy != "size" || !opts.Descending || opts.Depth != 2 || !opts.SkipHidden || !slices.Equal(opts.Include, []string{"*.go"}) || opts.GzipLevel != 9 || opts.Checksum != "md5" {
+		t.Errorf("walk options %+v", opts)
+	}
+	if render.format != "ndjson" {
+		t.Errorf("format %q", render.format)
+	}
+	if opts.MaxDepth != s.maxDepth {
+		t.Errorf("MaxDepth %d, want the server's %d", opts.MaxDepth, s.maxDepth)
+	}
+
+	for target, unknown := range map[string]string{
+		"/?dept=2": "dept",
+		"/?depth=2&Sort=size": "Sort",
+		"/?zzz=1&aaa=2": "aaa",
+	} {
+		_, _, err := s.parseOptions(httptest.NewRequest(http.MethodGet, target, nil))
+		if err == nil || !strings.Contains(err.Error(), `"`+unknown+`"`) {
+			t.Errorf("%s: %v, want an error naming %s", target, err, unknown)
+		}
+		e := decodeError(t, get(s.fileMetadataHandler, target), http.StatusBadRequest)
+		if !strings.Contains(e.Error, unknown) {
+			t.Errorf("%s: %q doesn't name %s", target, e.Error, unknown)
+		}
+	}
+}
+
+func TestXMLFormat(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "aaaa", "d/b & c.txt": "<b>", "d/e/f.go": "package f"})
+	s := newTestServer(t, root)
+	want := decodeTree(t, get(s.fileMetadataHandler, "/?checksum=md5"))
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"format=xml": get(s.fileMetadataHandler, "/?checksum=md5&format=xml"),
+		"Accept": getWith(s.fileMetadataHandler, "/?checksum=md5", map[string]string{"Accept": "application/xml;q=0.9, */*"}),
+	} {
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", name, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", name, ct)
+		}
+		var got metadata.FileMetadata
+		if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: decoding %s: %v", name, w.Body, err)
+		}
+		// Compare as JSON, which ignores how each decoder sets up times.
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		if !bytes.Equal(gotJSON, wantJSON) {
+			t.Errorf("%s: XML tree differs from the JSON one:\n%s\n%s", name, gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestETagCoversRendering(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "b"})
+	s := newTestServer(t, root)
+
+	tags := map[string]string{}
+	for _, query := range []string{"", "format=xml", "format=tree", "indent=4", "pretty=false", "human=true", "fields=filename", "time-format=unix", "realpath=true"} {
+		tag := get(s.fileMetadataHandler, "/?"+query).Header().Get("ETag")
+		if tag == "" {
+			t.Fatalf("%q: no ETag", query)
+		}
+		if other, ok := tags[tag]; ok {
+			t.Errorf("%q and %q share the ETag %s", query, other, tag)
+		}
+		tags[tag] = query
+		if again := get(s.fileMetadataHandler, "/?"+query).Header().Get("ETag"); again != tag {
+			t.Errorf("%q: ETag %s then %s for the same tree", query, tag, again)
+		}
+	}
+
+	// A JSON response's tag doesn't revalidate the XML one.
+	jsonTag := get(s.fileMetadataHandler, "/").Header().Get("ETag")
+	if w := getWith(s.fileMetadataHandler, "/", map[string]string{"Accept": "application/xml", "If-None-Match": jsonTag}); w.Code != http.StatusOK {
+		t.Errorf("XML revalidated with the JSON ETag: %d", w.Code)
+	}
+	if w := getWith(s.fileMetadataHandler, "/", map[string]string{"If-None-Match": jsonTag}); w.Code != http.StatusNotModified {
+		t.Errorf("JSON revalidated with its own ETag: %d, want 304", w.Code)
+	}
+}
+
+func TestSizeFilters(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"tiny": "x",
+		"small/a": strings.Repeat("a", 1000),
+		"small/b": strings.Repeat("b", 1500),
+		"big/c": strings.Repeat("c", 20_000),
+		"big/nested/d": strings.Repeat("d", 5000),
+	})
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, root)
+
+	files := func(md metadata.FileMetadata) []string {
+		var out []string
+		var collect func(metadata.FileMetadata)
+		collect = func(m metadata.FileMetadata) {
+			if m.Type == "file" {
+				out = append(out, m.Path)
+			}
+			for _, f := range m.Files {
+				collect(f)
+			}
+		}
+		collect(md)
+		return out
+	}
+	for query, want := range map[string][]string{
+		"min-size=2kb": {"big/c", "big/nested/d"},
+		"max-size=1KB": {"small/a", "tiny"},
+		"min-size=1000&max-size=5KB": {"big/nested/d", "small/a", "small/b"},
+		"min-size=1MiB": nil,
+	} {
+		md := decodeTree(t, get(s.fileMetadataHandler, "/?"+query))
+		if got := files(md); !slices.Equal(got, want) {
+			t.Errorf("%s: %q, want %q", query, got, want)
+		}
+		// Directories are kept only for what's below them that matches.
+		for _, f := range md.Files {
+			if f.Type == "directory" && f.FileCount == 0 {
+				t.Errorf("%s: %s kept with nothing in it matching", query, f.Path)
+			}
+		}
+	}
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?min-size=1000&max-size=5KB"))
+	if md.FileSize != 7500 || md.FileCount != 3 {
+		t.Errorf("filtered totals %d bytes in %d files, want 7500 in 3", md.FileSize, md.FileCount)
+	}
+	for _, query := range []string{"min-size=big", "max-size=-1", "min-size=10QB"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
+
+func TestPagingAfterFilters(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 10 {
+		// Every other entry is big enough to pass the filter.
+		files[fmt.Sprintf("f%02d", i)] = strings.Repeat("x", 100+i%2*1000)
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?min-size=1000&offset=1&limit=2"))
+	var got []string
+	for _, f := range md.Files {
+		got = append(got, f.Path)
+	}
+	if want := []string{"f03", "f05"}; !slices.Equal(got, want) {
+		t.Errorf("page %q, want %q", got, want)
+	}
+	if md.Total != 5 {
+		t.Errorf("total %d, want the 5 that pass the filter", md.Total)
+	}
+}
+
+// fileNames lists the paths of the regular files in md, in order.
+func fileNames(md metadata.FileMetadata) []string {
+	var out []string
+	if md.Type == "file" {
+		out = append(out, md.Path)
+	}
+	for _, f := range md.Files {
+		out = append(out, fileNames(f)...)
+	}
+	return out
+}
+
+func TestModifiedFilters(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"old": "o", "d/recent": "r", "d/older": "o", "d/e/new": "n"})
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old": 30 * 24 * time.Hour, "d/older": 7 * 24 * time.Hour, "d/recent": 2 * time.Hour, "d/e/new": time.Minute} {
+		mtime := now.Add(-age)
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, root)
+	cutoff := now.Add(-3 * 24 * time.Hour).UTC().Format(time.RFC3339)
+
+	for query, want := range map[string][]string{
+		"modified-after=-24h": {"d/e/new", "d/recent"},
+		"modified-after=" + cutoff: {"d/e/new", "d/recent"},
+		"modified-before=" + cutoff: {"d/older", "old"},
+		"modified-after=-240h&modified-before=-1h": {"d/older", "d/recent"},
+		"modified-after=-1s": nil,
+	} {
+		md := decodeTree(t, get(s.fileMetadataHandler, "/?"+query))
+		if got := fileNames(md); !slices.Equal(got, want) {
+			t.Errorf("%s: %q, want %q", query, got, want)
+		}
+		if query == "modified-before="+cutoff && len(md.Files) != 2 {
+			// d keeps d/older, and d/e has nothing old enough.
+			t.Errorf("%s: %d entries at the top, want d and old", query, len(md.Files))
+		}
+	}
+	for _, query := range []string{"modified-after=yesterday", "modified-before=2024-13-01T00:00:00Z", "modified-after=24"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"cmd/gms/main.go": "m", "cmd/gms/main_test.go": "t", "lib/util.go": "u", "lib/util.js": "j", "README.md": "r"})
+	s := newTestServer(t, root)
+
+	for pattern, want := range map[string][]string{
+		`\.go$`: {"cmd/gms/main.go", "cmd/gms/main_test.go", "lib/util.go"},
+		`^cmd/.*_test\.go$`: {"cmd/gms/main_test.go"},
+		// The whole relative path is matched, not just the name.
+		`lib/`: {"lib/util.go", "lib/util.js"},
+		`(?i)readme`: {"README.md"},
+		`nothing`: nil,
+	} {
+		md := decodeTree(t, get(s.fileMetadataHandler, "/?regex="+url.QueryEscape(pattern)))
+		if got := fileNames(md); !slices.Equal(got, want) {
+			t.Errorf("%s: %q, want %q", pattern, got, want)
+		}
+	}
+	md := decodeTree(t, get(s.fileMetadataHandler, "/?regex="+url.QueryEscape(`_test\.go$`)))
+	if len(md.Files) != 1 || md.Files[0].Path != "cmd" || md.DirCount != 2 {
+		t.Errorf("directories kept: %d at the top, %d in all; want only cmd and cmd/gms", len(md.Files), md.DirCount)
+	}
+
+	e := decodeError(t, get(s.fileMetadataHandler, "/?regex="+url.QueryEscape(`main(`)), http.StatusBadRequest)
+	if !strings.Contains(e.Error, "regex") {
+		t.Errorf("error %q doesn't say the regex is at fault", e.Error)
+	}
+}
+
+// slowFS takes delay over every call, counting the calls made.
+type slowFS struct {
+	fsys fs.FS
+	delay time.Duration
+	calls atomic.Int64
+}
+
+func (s *slowFS) wait() {
+	s.calls.Add(1)
+	time.Sleep(s.delay)
+}
+
+func (s *slowFS) Open(name string) (fs.File, error) { s.wait(); return s.fsys.Open(name) }
+func (s *slowFS) ReadDir(name string) ([]fs.DirEntry, error) { s.wait(); return fs.ReadDir(s.fsys, name) }
+func (s *slowFS) Stat(name string) (fs.FileInfo, error) { s.wait(); return fs.Stat(s.fsys, name) }
+func (s *slowFS) Lstat(name string) (fs.FileInfo, error) { s.wait(); return fs.Lstat(s.fsys, name) }
+func (s *slowFS) ReadLink(name string) (string, error) { s.wait(); return fs.ReadLink(s.fsys, name) }
+
+func TestMaxEntries(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 50 {
+		files[fmt.Sprintf("d%d/f%02d.txt", i%5, i)] = "x"
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+	s.maxEntries = 10
+
+	e := decodeError(t, get(s.fileMetadataHandler, "/"), http.StatusRequestEntityTooLarge)
+	if !strings.Contains(e.Error, "Too many entries") {
+		t.Errorf("error %q", e.Error)
+	}
+	// A subdirectory within the limit is still served.
+	s.maxEntries = 11
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/d0")); md.FileCount != 10 {
+		t.Errorf("d0: %d files, want 10", md.FileCount)
+	}
+	s.maxEntries = 0
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/")); md.FileCount != 50 {
+		t.Errorf("unlimited: %d files, want 50", md.FileCount)
+	}
+}
+
+// metricValue is the value of the unlabelled sample name in a scrape.
+func metricValue(t *testing.T, scrape, name string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(scrape, "\n") {
+		if v, ok := strings.CutPrefix(line, name+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("no %s in the scrape", name)
+	return 0
+}
+
+func TestMetricsShowWalksInFlight(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "d/b.txt": "b", "d/c.txt": "c", "e/f.txt": "f"})
+	s := newTestServer(t, root)
+	s.fsys = &slowFS{fsys: s.fsys, delay: 50 * time.Millisecond}
+	h := metricsMiddleware(http.HandlerFunc(s.fileMetadataHandler))
+	scrape := func() string { return get(promhttp.Handler().ServeHTTP, "/metrics").Body.String() }
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(h.ServeHTTP, "/") }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := scrape()
+		if metricValue(t, m, "gms_walks_in_flight") > 0 && metricValue(t, m, "gms_walk_goroutines_running") > 0 {
+			if n := metricValue(t, m, "gms_http_requests_in_flight"); n < 1 {
+				t.Errorf("%g requests in flight during the walk", n)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no walk seen in flight:\n%s", m)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	decodeTree(t, <-done)
+
+	m := scrape()
+	if n := metricValue(t, m, "gms_walks_in_flight"); n != 0 {
+		t.Errorf("%g walks in flight once the request is answered", n)
+	}
+	if n := metricValue(t, m, "gms_walk_goroutines_peak"); n < 1 {
+		t.Errorf("peak of %g walk goroutines", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 200 {
+		files[fmt.Sprintf("d%d/f%d", i%10, i)] = "x"
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+	slow := &slowFS{fsys: s.fsys, delay: 20 * time.Millisecond}
+	s.fsys = slow
+	s.limiter = metadata.NewLimiter(1)
+	s.requestTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	e := decodeError(t, get(s.fileMetadataHandler, "/"), http.StatusServiceUnavailable)
+	if e.Error != "Timed out walking the tree" {
+		t.Errorf("error %q", e.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("answered after %s with a 50ms timeout", elapsed)
+	}
+	// The walk was abandoned, not finished in the background.
+	time.Sleep(100 * time.Millisecond)
+	calls := slow.calls.Load()
+	time.Sleep(100 * time.Millisecond)
+	if more := slow.calls.Load(); more != calls || calls > 400 {
+		t.Errorf("%d calls, then %d; want the walk stopped well short of its 400 or so", calls, more)
+	}
+
+	s.requestTimeout = 0
+	slow.delay = 0
+	if md := decodeTree(t, get(s.fileMetadataHandler, "/?gzip=false")); md.FileCount != 200 {
+		t.Errorf("without a timeout: %d files, want 200", md.FileCount)
+	}
+}
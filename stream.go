@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"example/josh/goserver/metadata"
+)
+
+// flushEvery bounds how many entries are buffered before a flush when the
+// walk is producing them faster than they can be written.
+const flushEvery = 256
+
+// walkEntries walks name, handing each entry to fn as soon as the walk
+// completes it, and returns the walk's error once every entry has been
+// handed over. idle reports that no further entry is ready yet, which is
+// the moment to flush anything buffered.
+func (s *server) walkEntries(r *http.Request, name string, opts metadata.Options, fn func(e metadata.FileMetadata, idle bool)) error {
+	entries := make(chan metadata.FileMetadata, flushEvery)
+	opts.Emit = entries
+
+	var walkErr error
+	go func() {
+		_, walkErr = metadata.Walk(r.Context(), s.fsys, name, opts)
+		close(entries)
+	}()
+
+	for e := range entries {
+		fn(e, len(entries) == 0)
+	}
+	observeWalk(opts.Stats)
+	return walkErr
+}
+
+// streamEntries walks name and hands each entry to write as soon as the walk
+// completes it, flushing whenever it catches up with the walk so clients
+// see progress on large trees. The status and headers must already be set,
+// so a walk that fails part way is only returned, for the caller to end
+// the body with.
+func (s *server) streamEntries(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, write func(metadata.FileMetadata) error) error {
+	rc := http.NewResponseController(w)
+	var writeErr error
+	pending := 0
+	walkErr := s.walkEntries(r, name, opts, func(e metadata.FileMetadata, idle bool) {
+		// Once the client has gone, keep draining so the walk can finish
+		// unwinding; its context is already cancelled.
+		if writeErr != nil {
+			return
+		}
+		if e.Path == "." {
+			e.Filename = filepath.Base(s.root)
+		}
+		if writeErr = write(e); writeErr != nil {
+			return
+		}
+		pending++
+		if idle || pending >= flushEvery {
+			writeErr = rc.Flush()
+			pending = 0
+		}
+	})
+	return walkErr
+}
+
+// abortStream ends a streamed response whose walk failed after the 200 went
+// out. writeRecord adds a last record carrying the status the walk would
+// otherwise have been answered with, and the connection is then dropped
+// rather than the body finished, so no client mistakes the truncated
+// listing for a whole one.
+func abortStream(w http.ResponseWriter, r *http.Request, name string, err error, writeRecord func(status int, msg string) error) {
+	slog.WarnContext(r.Context(), "streaming walk ended early", "path", name, "err", err)
+	if !errors.Is(err, context.Canceled) {
+		status, msg := walkErrorStatus(err)
+		if writeRecord(status, msg) == nil {
+			http.NewResponseController(w).Flush()
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// streamNDJSON writes one JSON object per line for every entry in the tree.
+func (s *server) streamNDJSON(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, render renderOptions) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	err := s.streamEntries(w, r, name, opts, func(e metadata.FileMetadata) error {
+		if render.human != "" {
+			addHumanSizes(&e, render.human == "si")
+		}
+		if render.realPath {
+			addRealPaths(&e, s.root)
+		}
+		if render.reshapes() {
+			reshaped, err := reshape(e, render)
+			if err != nil {
+				return err
+			}
+			return encoder.Encode(reshaped)
+		}
+		return encoder.Encode(e)
+	})
+	if err != nil {
+		abortStream(w, r, name, err, func(status int, msg string) error {
+			return encoder.Encode(apiError{Error: msg, Code: status})
+		})
+	}
+}
+
+// csvHeader names the columns written by streamCSV.
+var csvHeader = []string{"path", "type", "size", "gzipped_size", "mtime"}
+
+// streamCSV writes a flattened listing with one row per entry. Directories
+// get a row too, with the size columns left empty, and gzipped_size is empty
+// wherever no gzip size was measured. A walk that fails part way ends with
+// a row of type error, its message in the path column.
+func (s *server) streamCSV(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, render renderOptions) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return
+	}
+	err := s.streamEntries(w, r, name, opts, func(e metadata.FileMetadata) error {
+		var size, gzipped string
+		if e.Type != "directory" {
+			size = strconv.FormatInt(e.FileSize, 10)
+			if e.FileSizeGzipped != nil {
+				gzipped = strconv.FormatInt(*e.FileSizeGzipped, 10)
+			}
+		}
+		cw.Write([]string{e.Path, e.Type, size, gzipped, fmt.Sprint(formatTime(e.LastModifiedDate.UTC(), render.timeFormat))})
+		// Hand each row to the response so streamEntries' flushes reach
+		// the client.
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		abortStream(w, r, name, err, func(status int, msg string) error {
+			cw.Write([]string{msg, "error", "", "", ""})
+			cw.Flush()
+			return cw.Error()
+		})
+	}
+}
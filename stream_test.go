@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSV(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "aaaa", "d/b,c.txt": "b\"c", "d/e/f.txt": ""})
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	for _, name := range []string{".", "a.txt", "d", "d/b,c.txt", "d/e", "d/e/f.txt"} {
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, root)
+	tree := decodeTree(t, get(s.fileMetadataHandler, "/"))
+
+	w := get(s.fileMetadataHandler, "/?format=csv")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rows[0], csvHeader) {
+		t.Errorf("header %q", rows[0])
+	}
+	gzipped := func(p string) string {
+		return strconv.FormatInt(*findFile(t, tree, p).FileSizeGzipped, 10)
+	}
+	const ts = "2024-05-06T07:08:09Z"
+	want := map[string][]string{
+		".": {".", "directory", "", "", ts},
+		"a.txt": {"a.txt", "file", "4", gzipped("a.txt"), ts},
+		"d": {"d", "directory", "", "", ts},
+		"d/b,c.txt": {"d/b,c.txt", "file", "3", gzipped("d/b,c.txt"), ts},
+		"d/e": {"d/e", "directory", "", "", ts},
+		"d/e/f.txt": {"d/e/f.txt", "file", "0", gzipped("d/e/f.txt"), ts},
+	}
+	if len(rows)-1 != len(want) {
+		t.Errorf("%d rows, want %d: %q", len(rows)-1, len(want), rows[1:])
+	}
+	for _, row := range rows[1:] {
+		if !slices.Equal(row, want[row[0]]) {
+			t.Errorf("row %q, want %q", row, want[row[0]])
+		}
+	}
+
+	// Without compression the gzipped column is left empty.
+	rows, err = csv.NewReader(get(s.fileMetadataHandler, "/a.txt?format=csv&gzip=false").Body).ReadAll()
+	if err != nil || len(rows) != 2 || rows[1][3] != "" {
+		t.Errorf("gzip=false: %q, %v", rows, err)
+	}
+	if rows, _ := csv.NewReader(get(s.fileMetadataHandler, "/a.txt?format=csv&time-format=unix").Body).ReadAll(); len(rows) != 2 || rows[1][4] != "1714979289" {
+		t.Errorf("time-format=unix: %q", rows)
+	}
+}
+
+// getAborted sends a GET for target to h, reporting whether h aborted the
+// response with http.ErrAbortHandler as net/http would see it.
+func getAborted(t *testing.T, h http.HandlerFunc, target string) (w *httptest.ResponseRecorder, aborted bool) {
+	t.Helper()
+	w = httptest.NewRecorder()
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+	h(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w, false
+}
+
+func TestStreamEndsWithErrorRecord(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 50 {
+		files[filepath.Join("d", strings.Repeat("x", i+1))] = "x"
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+	s.maxEntries = 10
+
+	w, aborted := getAborted(t, s.fileMetadataHandler, "/?format=ndjson")
+	if !aborted {
+		t.Error("ndjson: the response was finished, not aborted")
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	var last apiError
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last.Code != http.StatusRequestEntityTooLarge || last.Error == "" {
+		t.Errorf("ndjson: last line %q, want a 413 error record", lines[len(lines)-1])
+	}
+	if len(lines) > 11 {
+		t.Errorf("ndjson: %d lines past a limit of 10 entries", len(lines))
+	}
+
+	w, aborted = getAborted(t, s.fileMetadataHandler, "/?format=csv")
+	if !aborted {
+		t.Error("csv: the response was finished, not aborted")
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := rows[len(rows)-1]; last[1] != "error" || last[0] == "" {
+		t.Errorf("csv: last row %q, want an error row", last)
+	}
+
+	// A walk that fails before anything is sent is answered as usual.
+	s.maxEntries = 0
+	decodeError(t, get(s.fileMetadataHandler, "/missing?format=ndjson"), http.StatusNotFound)
+}
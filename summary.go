@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+
+	"example/josh/goserver/metadata"
+)
+
+// summary is the flat ?format=summary response: totals over every regular
+// file under a path instead of the tree itself.
+type summary struct {
+	Path string `json:"path"`
+	Files int `json:"files"`
+	Directories int `json:"directories"`
+	TotalSize int64 `json:"total_size"`
+	TotalCompressedSize int64 `json:"total_compressed_size"`
+	CompressionAlgo string `json:"compression_algo,omitempty"`
+	// Errors counts entries that could not be read.
+	Errors int `json:"errors"`
+	// HardLinks counts files left out under ?dedupe because another link
+	// to the same file was already counted.
+	HardLinks int `json:"hard_links,omitempty"`
+	Largest *fileRef `json:"largest,omitempty"`
+	Oldest *fileRef `json:"oldest,omitempty"`
+	Newest *fileRef `json:"newest,omitempty"`
+	// Extensions breaks the file totals down by extension, including the
+	// dot; files without one are counted under noExtension.
+	Extensions map[string]*extensionTotals `json:"extensions"`
+
+	// seen holds the files counted so far when deduplicating, and is nil
+	// otherwise.
+	seen map[fileID]bool
+}
+
+// fileID identifies a file on disk, whatever name it was reached by.
+type fileID struct {
+	dev, inode uint64
+}
+
+// noExtension is the Extensions key for files without an extension.
+const noExtension = "(none)"
+
+type extensionTotals struct {
+	Count int `json:"count"`
+	TotalSize int64 `json:"total_size"`
+	TotalCompressedSize int64 `json:"total_compressed_size"`
+}
+
+// fileRef identifies one file picked out by a summary.
+type fileRef struct {
+	Path string `json:"path"`
+	FileSize int64 `json:"file_size"`
+	LastModifiedDate time.Time `json:"last_modified_date"`
+}
+
+func (s *summary) add(e metadata.FileMetadata) {
+	if e.Error != "" {
+		s.Errors++
+		return
+	}
+	switch e.Type {
+	case "directory":
+		if e.Path != s.Path {
+			s.Directories++
+		}
+		return
+	case "file":
+	default:
+		return
+	}
+
+	// Files without an inode, where the platform reports none, are all
+	// counted.
+	if s.seen != nil && e.Inode != nil && e.Dev != nil {
+		id := fileID{*e.Dev, *e.Inode}
+		if s.seen[id] {
+			s.HardLinks++
+			return
+		}
+		s.seen[id] = true
+	}
+
+	s.Files++
+	s.TotalSize += e.FileSize
+	s.TotalCompressedSize += e.CompressedSize
+	if e.CompressionAlgo != "" {
+		s.CompressionAlgo = e.CompressionAlgo
+	}
+
+	ext := path.Ext(e.Filename)
+	if ext == "" {
+		ext = noExtension
+	}
+	totals := s.Extensions[ext]
+	if totals == nil {
+		totals = &extensionTotals{}
+		s.Extensions[ext] = totals
+	}
+	totals.Count++
+	totals.TotalSize += e.FileSize
+	totals.TotalCompressedSize += e.CompressedSize
+
+	ref := &fileRef{Path: e.Path, FileSize: e.FileSize, LastModifiedDate: e.LastModifiedDate}
+	if s.Largest == nil || e.FileSize > s.Largest.FileSize {
+		s.Largest = ref
+	}
+	if s.Oldest == nil || e.LastModifiedDate.Before(s.Oldest.LastModifiedDate) {
+		s.Oldest = ref
+	}
+	if s.Newest == nil || e.LastModifiedDate.After(s.Newest.LastModifiedDate) {
+		s.Newest = ref
+	}
+}
+
+// serveSummary walks name once, folding each entry into the summary as it
+// is emitted so the tree is never held in memory.
+func (s *server) serveSummary(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, render renderOptions) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sum := summary{Path: name, Extensions: map[string]*extensionTotals{}}
+	if render.dedupe {
+		sum.seen = make(map[fileID]bool)
+	}
+	err := s.walkEntries(r, name, opts, func(e metadata.FileMetadata, _ bool) { sum.add(e) })
+	if err != nil {
+		writeWalkError(w, r, name, err)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", render.indent)
+	if err := encoder.Encode(sum); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating JSON")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example/josh/goserver/metadata"
+)
+
+// summaryTree writes a tree whose files each have a known mtime.
+func summaryTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"a.go": "package a",
+		"b.js": "console.log('b')",
+		"docs/readme.md": "# readme",
+		"docs/big.bin": string(make([]byte, 4096)),
+		"docs/deep/Makefile": "all:",
+		"docs/deep/c.go": "package c",
+	}
+	writeFiles(t, root, files)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{
+		"a.go": 0, "b.js": time.Hour, "docs/readme.md": -48 * time.Hour,
+		"docs/big.bin": 2 * time.Hour, "docs/deep/Makefile": 72 * time.Hour, "docs/deep/c.go": 3 * time.Hour,
+	} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), base.Add(age), base.Add(age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func decodeSummary(t *testing.T, h http.HandlerFunc, target string) summary {
+	t.Helper()
+	w := get(h, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, w.Code, w.Body)
+	}
+	var sum summary
+	if err := json.Unmarshal(w.Body.Bytes(), &sum); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return sum
+}
+
+func TestSummary(t *testing.T) {
+	s := newTestServer(t, summaryTree(t))
+	tree := decodeTree(t, get(s.fileMetadataHandler, "/"))
+	sum := decodeSummary(t, s.fileMetadataHandler, "/?format=summary")
+
+	if sum.Path != "." || sum.Files != 6 || sum.Directories != 2 || sum.Errors != 0 {
+		t.Errorf("%q: %d files, %d directories, %d errors; want 6, 2, 0", sum.Path, sum.Files, sum.Directories, sum.Errors)
+	}
+	if sum.TotalSize != tree.FileSize || sum.TotalCompressedSize != tree.CompressedSize || sum.CompressionAlgo != "gzip" {
+		t.Errorf("totals %d and %d %s, want the tree's %d and %d", sum.TotalSize, sum.TotalCompressedSize, sum.CompressionAlgo, tree.FileSize, tree.CompressedSize)
+	}
+	if sum.Largest == nil || sum.Largest.Path != "docs/big.bin" || sum.Largest.FileSize != 4096 {
+		t.Errorf("largest %+v, want docs/big.bin", sum.Largest)
+	}
+	if sum.Newest == nil || sum.Newest.Path != "docs/deep/Makefile" {
+		t.Errorf("newest %+v, want docs/deep/Makefile", sum.Newest)
+	}
+	if sum.Oldest == nil || sum.Oldest.Path != "docs/readme.md" {
+		t.Errorf("oldest %+v, want docs/readme.md", sum.Oldest)
+	}
+
+	sub := decodeSummary(t, s.fileMetadataHandler, "/docs/deep?format=summary")
+	if sub.Path != "docs/deep" || sub.Files != 2 || sub.Directories != 0 || sub.Largest.Path != "docs/deep/c.go" {
+		t.Errorf("docs/deep: %q with %d files, %d directories, largest %+v", sub.Path, sub.Files, sub.Directories, sub.Largest)
+	}
+	decodeError(t, get(s.fileMetadataHandler, "/missing?format=summary"), http.StatusNotFound)
+}
+
+func TestSummaryExtensions(t *testing.T) {
+	root := summaryTree(t)
+	writeFiles(t, root, map[string]string{".bashrc": "alias", "archive.tar.gz": "gz", "UPPER.GO": "package upper"})
+	s := newTestServer(t, root)
+	tree := decodeTree(t, get(s.fileMetadataHandler, "/"))
+	sum := decodeSummary(t, s.fileMetadataHandler, "/?format=summary")
+
+	sizes := map[string]int64{}
+	for _, p := range []string{"a.go", "docs/deep/c.go"} {
+		sizes[p] = findFile(t, tree, p).CompressedSize
+	}
+	want := map[string]extensionTotals{
+		".go": {2, 18, sizes["a.go"] + sizes["docs/deep/c.go"]},
+		".js": {1, 16, findFile(t, tree, "b.js").CompressedSize},
+		".md": {1, 8, findFile(t, tree, "docs/readme.md").CompressedSize},
+		".bin": {1, 4096, findFile(t, tree, "docs/big.bin").CompressedSize},
+		// Only the last dot counts, and case is kept.
+		".gz": {1, 2, findFile(t, tree, "archive.tar.gz").CompressedSize},
+		".GO": {1, 13, findFile(t, tree, "UPPER.GO").CompressedSize},
+		// A dotfile's name is all extension, as path.Ext has it.
+		".bashrc": {1, 5, findFile(t, tree, ".bashrc").CompressedSize},
+		noExtension: {1, 4, findFile(t, tree, "docs/deep/Makefile").CompressedSize},
+	}
+	if len(sum.Extensions) != len(want) {
+		t.Errorf("%d extensions, want %d: %v", len(sum.Extensions), len(want), sum.Extensions)
+	}
+	count := 0
+	for ext, w := range want {
+		got := sum.Extensions[ext]
+		if got == nil || *got != w {
+			t.Errorf("%s: %+v, want %+v", ext, got, w)
+			continue
+		}
+		count += got.Count
+	}
+	if count != sum.Files {
+		t.Errorf("extensions count %d files, the summary %d", count, sum.Files)
+	}
+}
+
+// findFile returns the entry at p in tree, failing if there isn't one.
+func findFile(t *testing.T, tree metadata.FileMetadata, p string) metadata.FileMetadata {
+	t.Helper()
+	if tree.Path == p {
+		return tree
+	}
+	for _, f := range tree.Files {
+		if f.Path == p || strings.HasPrefix(p, f.Path+"/") {
+			return findFile(t, f, p)
+		}
+	}
+	t.Fatalf("%s not in the tree", p)
+	return metadata.FileMetadata{}
+}
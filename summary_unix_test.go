@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSummaryDedupesHardLinks(t *testing.T) {
+	root := t.TempDir()
+	big := strings.Repeat("x", 1000)
+	writeFiles(t, root, map[string]string{"a.bin": big, "c.txt": "ccc"})
+	for _, name := range []string{"b.bin", "d/e.bin"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(root, "a.bin"), filepath.Join(root, name)); err != nil {
+			t.Skipf("link: %v", err)
+		}
+	}
+	s := newTestServer(t, root)
+
+	sum := decodeSummary(t, s.fileMetadataHandler, "/?format=summary")
+	if sum.Files != 4 || sum.TotalSize != 3003 || sum.HardLinks != 0 {
+		t.Errorf("without dedupe: %d files of %d bytes, %d links left out; want every name counted, 4 of 3003", sum.Files, sum.TotalSize, sum.HardLinks)
+	}
+	sum = decodeSummary(t, s.fileMetadataHandler, "/?format=summary&dedupe=true")
+	if sum.Files != 2 || sum.TotalSize != 1003 || sum.HardLinks != 2 {
+		t.Errorf("with dedupe: %d files of %d bytes, %d links left out; want 2 of 1003 with 2 left out", sum.Files, sum.TotalSize, sum.HardLinks)
+	}
+	if ext := sum.Extensions[".bin"]; ext == nil || ext.Count != 1 || ext.TotalSize != 1000 {
+		t.Errorf(".bin totals %+v, want the one file", ext)
+	}
+	for _, query := range []string{"dedupe=true", "format=summary&dedupe=maybe"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?"+query), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"example/josh/goserver/metadata"
+)
+
+// defaultTop and maxTop bound ?n for ?format=top.
+const (
+	defaultTop = 50
+	maxTop = 10000
+)
+
+// topFiles keeps the n largest regular files it is offered. It is a
+// min-heap, so the smallest of those kept is the first to go.
+type topFiles struct {
+	n int
+	size func(metadata.FileMetadata) (int64, bool)
+	files []metadata.FileMetadata
+}
+
+// larger orders files by size, breaking ties by path so the result is
+// stable.
+func (t *topFiles) larger(a, b metadata.FileMetadata) bool {
+	sa, _ := t.size(a)
+	sb, _ := t.size(b)
+	if sa != sb {
+		return sa > sb
+	}
+	return a.Path < b.Path
+}
+
+func (t *topFiles) Len() int { return len(t.files) }
+func (t *topFiles) Less(i, j int) bool { return t.larger(t.files[j], t.files[i]) }
+func (t *topFiles) Swap(i, j int) { t.files[i], t.files[j] = t.files[j], t.files[i] }
+func (t *topFiles) Push(x any) { t.files = append(t.files, x.(metadata.FileMetadata)) }
+func (t *topFiles) Pop() any {
+	last := t.files[len(t.files)-1]
+	t.files = t.files[:len(t.files)-1]
+	return last
+}
+
+func (t *topFiles) add(e metadata.FileMetadata) {
+	if e.Type != "file" || e.Error != "" {
+		return
+	}
+	if _, ok := t.size(e); !ok {
+		return
+	}
+	if len(t.files) < t.n {
+		heap.Push(t, e)
+		return
+	}
+	if t.larger(e, t.files[0]) {
+		t.files[0] = e
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the files kept, largest first.
+func (t *topFiles) sorted() []metadata.FileMetadata {
+	files := append([]metadata.FileMetadata{}, t.files...)
+	slices.SortFunc(files, func(a, b metadata.FileMetadata) int {
+		if t.larger(a, b) {
+			return -1
+		}
+		return 1
+	})
+	return files
+}
+
+func sizeOf(e metadata.FileMetadata) (int64, bool) { return e.FileSize, true }
+
+func gzippedSizeOf(e metadata.FileMetadata) (int64, bool) {
+	if e.FileSizeGzipped == nil {
+		return 0, false
+	}
+	return *e.FileSizeGzipped, true
+}
+
+// serveTop walks name once and answers with the largest files beneath it,
+// holding no more than render.top of them at a time however large the tree.
+func (s *server) serveTop(w http.ResponseWriter, r *http.Request, name string, opts metadata.Options, render renderOptions) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	top := &topFiles{n: render.top, size: sizeOf}
+	if render.topBy == "gzipped" {
+		top.size = gzippedSizeOf
+	}
+	err := s.walkEntries(r, name, opts, func(e metadata.FileMetadata, _ bool) { top.add(e) })
+	if err != nil {
+		writeWalkError(w, r, name, err)
+		return
+	}
+
+	files := top.sorted()
+	for i := range files {
+		if render.human != "" {
+			addHumanSizes(&files[i], render.human == "si")
+		}
+		if render.realPath {
+			addRealPaths(&files[i], s.root)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", render.indent)
+	if err := encoder.Encode(files); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating JSON")
+	}
+}
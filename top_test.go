@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"example/josh/goserver/metadata"
+)
+
+// decodeList decodes a flat list of entries, as ?format=top and ?search
+// answer with, failing unless the response is a 200.
+func decodeList(t *testing.T, h http.HandlerFunc, target string) []metadata.FileMetadata {
+	t.Helper()
+	w := get(h, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, w.Code, w.Body)
+	}
+	var files []metadata.FileMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+		t.Fatalf("%s: decoding %s: %v", target, w.Body, err)
+	}
+	return files
+}
+
+func paths(files []metadata.FileMetadata) []string {
+	var out []string
+	for _, f := range files {
+		out = append(out, f.Path)
+	}
+	return out
+}
+
+func TestTop(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"small.txt": "s",
+		"a/text.txt": strings.Repeat("compressible ", 1000),
+		"a/b/random.bin": string(random),
+		"a/b/c/mid.txt": strings.Repeat("m", 500),
+		"tie1.txt": strings.Repeat("t", 500),
+		"empty.txt": "",
+	})
+	s := newTestServer(t, root)
+
+	got := paths(decodeList(t, s.fileMetadataHandler, "/?format=top&n=4"))
+	if want := []string{"a/text.txt", "a/b/random.bin", "a/b/c/mid.txt", "tie1.txt"}; !slices.Equal(got, want) {
+		t.Errorf("top 4 by size %q, want %q", got, want)
+	}
+	// What compresses worst comes first by gzipped size.
+	files := decodeList(t, s.fileMetadataHandler, "/?format=top&n=2&by=gzipped")
+	if got := paths(files); !slices.Equal(got, []string{"a/b/random.bin", "a/text.txt"}) {
+		t.Errorf("top 2 by gzipped size %q, want random.bin then text.txt", got)
+	}
+	if *files[0].FileSizeGzipped < *files[1].FileSizeGzipped {
+		t.Errorf("gzipped sizes %d then %d, want largest first", *files[0].FileSizeGzipped, *files[1].FileSizeGzipped)
+	}
+	// Only files are listed, and n past their number lists them all.
+	if got := decodeList(t, s.fileMetadataHandler, "/?format=top&n=100"); len(got) != 6 {
+		t.Errorf("n=100 listed %q, want the 6 files", paths(got))
+	}
+	if got := paths(decodeList(t, s.fileMetadataHandler, "/a/b?format=top")); !slices.Equal(got, []string{"a/b/random.bin", "a/b/c/mid.txt"}) {
+		t.Errorf("under a/b: %q", got)
+	}
+
+	// Only gzip fills in the sizes by=gzipped ranks by.
+	if got := decodeList(t, s.fileMetadataHandler, "/?format=top&n=1&by=gzipped&compression=gzip"); len(got) != 1 {
+		t.Errorf("compression=gzip listed %q, want one file", paths(got))
+	}
+	for _, query := range []string{"n=0", "n=-1", "n=many", fmt.Sprintf("n=%d", maxTop+1), "by=name", "by=gzipped&compression=brotli", "by=gzipped&compression=zstd"} {
+		decodeError(t, get(s.fileMetadataHandler, "/?format=top&"+query), http.StatusBadRequest)
+	}
+}
+
+func TestTopFilesKeepsOnlyN(t *testing.T) {
+	top := &topFiles{n: 5, size: sizeOf}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(10000) {
+		top.add(metadata.FileMetadata{Type: "file", Path: fmt.Sprintf("f%05d", i), FileSize: int64(i)})
+		if top.Len() > 5 {
+			t.Fatalf("holding %d files, want at most 5", top.Len())
+		}
+	}
+	top.add(metadata.FileMetadata{Type: "directory", Path: "d", FileSize: 1 << 40})
+	top.add(metadata.FileMetadata{Type: "file", Path: "broken", FileSize: 1 << 40, Error: "permission denied"})
+	if got := paths(top.sorted()); !slices.Equal(got, []string{"f09999", "f09998", "f09997", "f09996", "f09995"}) {
+		t.Errorf("kept %q, want the five largest files", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"example/josh/goserver/metadata"
+)
+
+// writeTree renders m like the tree command: one line per entry, with
+// branch characters showing the nesting and each file's compressed size.
+func writeTree(w io.Writer, m metadata.FileMetadata) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, treeLabel(m))
+	writeTreeChildren(bw, m.Files, "")
+	return bw.Flush()
+}
+
+func writeTreeChildren(w io.Writer, files []metadata.FileMetadata, prefix string) {
+	for i, f := range files {
+		branch, indent := "├── ", "│   "
+		if i == len(files)-1 {
+			branch, indent = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%s%s%s\n", prefix, branch, treeLabel(f))
+		writeTreeChildren(w, f.Files, prefix+indent)
+	}
+}
+
+// treeLabel is the text for one entry: its name, then its compressed size,
+// link target, error or the cycle it closes.
+func treeLabel(m metadata.FileMetadata) string {
+	switch {
+	case m.Error != "":
+		return fmt.Sprintf("%s [error: %s]", m.Filename, m.Error)
+	case m.Cycle:
+		return fmt.Sprintf("%s -> %s [cycle]", m.Filename, m.LinkTarget)
+	case m.Type == "symlink":
+		return fmt.Sprintf("%s -> %s", m.Filename, m.LinkTarget)
+	case m.Type == "directory" && m.OtherFilesystem:
+		return fmt.Sprintf("%s/ [other file system]", m.Filename)
+	case m.Type == "directory" && m.Truncated:
+		return fmt.Sprintf("%s/ [not walked]", m.Filename)
+	case m.Type == "directory":
+		return fmt.Sprintf("%s/ (%s)", m.Filename, formatSize(m.CompressedSize, false))
+	case m.Type == "file":
+		return fmt.Sprintf("%s (%s)", m.Filename, formatSize(m.CompressedSize, false))
+	}
+	return fmt.Sprintf("%s [%s]", m.Filename, m.Type)
+}
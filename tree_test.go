@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example/josh/goserver/metadata"
+)
+
+func TestWriteTree(t *testing.T) {
+	dir := func(name string, size int64, files ...metadata.FileMetadata) metadata.FileMetadata {
+		return metadata.FileMetadata{Filename: name, Type: "directory", CompressedSize: size, Files: files}
+	}
+	file := func(name string, size int64) metadata.FileMetadata {
+		return metadata.FileMetadata{Filename: name, Type: "file", CompressedSize: size}
+	}
+	tree := dir("root", 5000,
+		dir("src", 3000,
+			file("main.go", 2048),
+			dir("internal", 952, file("x.go", 952)),
+		),
+		metadata.FileMetadata{Filename: "latest", Type: "symlink", LinkTarget: "src"},
+		metadata.FileMetadata{Filename: "locked", Error: "permission denied"},
+		metadata.FileMetadata{Filename: "fifo", Type: "pipe"},
+		dir("vendor", 0),
+		file("README", 12),
+	)
+	tree.Files[4].Truncated = true
+
+	var buf bytes.Buffer
+	if err := writeTree(&buf, tree); err != nil {
+		t.Fatal(err)
+	}
+	want := `root/ (4.9 KiB)
+├── src/ (2.9 KiB)
+│   ├── main.go (2.0 KiB)
+│   └── internal/ (952 B)
+│       └── x.go (952 B)
+├── latest -> src
+├── locked [error: permission denied]
+├── fifo [pipe]
+├── vendor/ [not walked]
+└── README (12 B)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTreeFormat(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"b.txt": "bb", "a.txt": strings.Repeat("a", 5000), "c/d.txt": "d"})
+	s := newTestServer(t, root)
+
+	for target, order := range map[string][]string{
+		"/?format=tree": {"a.txt", "b.txt", "c/", "d.txt"},
+		"/?format=tree&sort=size&order=desc": {"a.txt", "b.txt", "c/", "d.txt"},
+		"/?format=tree&sort=size": {"c/", "d.txt", "b.txt", "a.txt"},
+		"/?format=tree&order=desc": {"c/", "d.txt", "b.txt", "a.txt"},
+	} {
+		w := get(s.fileMetadataHandler, target)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Fatalf("%s: status %d, Content-Type %q", target, w.Code, w.Header().Get("Content-Type"))
+		}
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if len(lines) != len(order)+1 {
+			t.Fatalf("%s: %d lines, want %d:\n%s", target, len(lines), len(order)+1, w.Body)
+		}
+		for i, name := range order {
+			if !strings.Contains(lines[i+1], "── "+name) {
+				t.Errorf("%s: line %d is %q, want %s", target, i+1, lines[i+1], name)
+			}
+		}
+	}
+	if w := getWith(s.fileMetadataHandler, "/", map[string]string{"Accept": "text/plain"}); !strings.Contains(w.Body.String(), "└── ") {
+		t.Errorf("Accept: text/plain didn't draw a tree:\n%s", w.Body)
+	}
+}
+
+// cutOffWriter accepts the first limit bytes of a body, as a connection
+// that drops part way through would, and counts WriteHeader calls.
+type cutOffWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+	headers int
+}
+
+func (c *cutOffWriter) WriteHeader(code int) {
+	c.headers++
+	c.ResponseRecorder.WriteHeader(code)
+}
+
+func (c *cutOffWriter) Write(b []byte) (int, error) {
+	if c.Body.Len()+len(b) > c.limit {
+		return 0, errors.New("connection reset")
+	}
+	return c.ResponseRecorder.Write(b)
+}
+
+func TestFailedBodyWriteIsNotFollowedByAnError(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := range 200 {
+		files[fmt.Sprintf("file%03d.txt", i)] = "x"
+	}
+	writeFiles(t, root, files)
+	s := newTestServer(t, root)
+
+	for _, format := range []string{"tree", "xml", "json"} {
+		w := &cutOffWriter{ResponseRecorder: httptest.NewRecorder(), limit: 2048}
+		s.fileMetadataHandler(w, httptest.NewRequest(http.MethodGet, "/?format="+format, nil))
+		if w.Code != http.StatusOK || w.headers > 1 {
+			t.Errorf("%s: status %d after %d WriteHeader calls, want one 200", format, w.Code, w.headers)
+		}
+		if bytes.Contains(w.Body.Bytes(), []byte(`"error"`)) {
+			t.Errorf("%s: an error was appended to the body:\n%s", format, w.Body)
+		}
+	}
+}
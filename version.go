@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set at build time with, for example,
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Whatever is left unset is taken from the build info Go records.
+var (
+	version = ""
+	commit = ""
+	buildDate = ""
+)
+
+// buildVersion is the /version response.
+type buildVersion struct {
+	Version string `json:"version"`
+	Commit string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	// Modified marks a build from a working tree with uncommitted changes.
+	Modified bool `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentVersion fills in from debug.ReadBuildInfo what -ldflags didn't:
+// the module version under go install, and the VCS revision and commit
+// time under go build in a checkout. A plain development build is "dev".
+var currentVersion = sync.OnceValue(func() buildVersion {
+	v := buildVersion{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		if v.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v.Version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = setting.Value
+				}
+			case "vcs.time":
+				if v.BuildDate == "" {
+					v.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				v.Modified = setting.Value == "true"
+			}
+		}
+	}
+	if v.Version == "" {
+		v.Version = "dev"
+	}
+	return v
+})
+
+// versionHandler reports which build is running.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(currentVersion())
+}
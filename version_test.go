@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	w := get(versionHandler, "/version")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	// A test binary has no module version or -ldflags, so it is "dev".
+	if v, _ := got["version"].(string); v == "" {
+		t.Errorf("version %v, want it set, if only to dev", got["version"])
+	}
+	if got["go_version"] != runtime.Version() {
+		t.Errorf("go_version %v, want %s", got["go_version"], runtime.Version())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+}
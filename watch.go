@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+
+	"example/josh/goserver/metadata"
+)
+
+// watchRoot evicts cache entries as files under root change, until ctx is
+// cancelled. fsnotify does not watch recursively, so every directory is
+// added on its own, including ones created later.
+func watchRoot(ctx context.Context, logger *slog.Logger, root string, cache *metadata.Cache) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := addWatches(w, root); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				handleWatchEvent(logger, w, root, cache, ev)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// Events were dropped, so any entry could be stale.
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					cache.Clear()
+				}
+				logger.Warn("watching root", "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// addWatches watches dir and every directory beneath it. Directories that
+// vanish or can't be read while this runs are skipped.
+func addWatches(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := w.Add(path); err != nil && path == dir {
+			return err
+		}
+		return nil
+	})
+}
+
+func handleWatchEvent(logger *slog.Logger, w *fsnotify.Watcher, root string, cache *metadata.Cache, ev fsnotify.Event) {
+	if !within(root, ev.Name) {
+		return
+	}
+	rel, _ := filepath.Rel(root, ev.Name)
+	// A write or chmod only changes the one file. Anything else may add,
+	// remove or replace a whole directory, so look for entries beneath it.
+	if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		cache.Evict(filepath.ToSlash(rel))
+	} else {
+		cache.EvictFile(filepath.ToSlash(rel))
+	}
+
+	if ev.Has(fsnotify.Create) {
+		if err := addWatches(w, ev.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("watching new directory", "path", ev.Name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"example/josh/goserver/metadata"
+)
+
+func TestWatchRootEvictsChangedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "aaaaaaaa", "d/b.txt": "bbbbbbbb"})
+	counter := &openCounter{fsys: os.DirFS(root)}
+	opts := metadata.DefaultOptions()
+	opts.Cache = metadata.NewCache(100)
+	walk := func() int64 {
+		t.Helper()
+		counter.opens.Store(0)
+		if _, err := metadata.Walk(context.Background(), counter, ".", opts); err != nil {
+			t.Fatal(err)
+		}
+		return counter.opens.Load()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := watchRoot(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), root, opts.Cache); err != nil {
+		t.Fatal(err)
+	}
+	walk()
+	if n := walk(); n != 0 {
+		t.Fatalf("unchanged tree: opened %d files, want none", n)
+	}
+
+	// Rewriting a file and putting its mtime back leaves nothing for the
+	// cache to notice; only the watcher can evict it.
+	rewrite := func(name, data string) {
+		t.Helper()
+		p := filepath.Join(root, filepath.FromSlash(name))
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForOpens := func(what string, want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			n := walk()
+			if n == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: the walk opened %d files, want %d", what, n, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	rewrite("d/b.txt", "BBBBBBBB")
+	waitForOpens("after d/b.txt changed", 1)
+
+	// Directories created after the watch started are watched as well.
+	if err := os.Mkdir(filepath.Join(root, "new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{"new/c.txt": "cccccccc"})
+	waitForOpens("after new/c.txt was created", 1)
+	walk()
+	rewrite("new/c.txt", "CCCCCCCC")
+	waitForOpens("after new/c.txt changed", 1)
+}
+
+func TestWatchEventEvictsBeneathOnlyForDirectoryChanges(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"d/b.txt": "bbbbbbbb"})
+	counter := &openCounter{fsys: os.DirFS(root)}
+	opts := metadata.DefaultOptions()
+	opts.Cache = metadata.NewCache(100)
+	walk := func() int64 {
+		t.Helper()
+		counter.opens.Store(0)
+		if _, err := metadata.Walk(context.Background(), counter, ".", opts); err != nil {
+			t.Fatal(err)
+		}
+		return counter.opens.Load()
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// A Create adds watches, so it needs a watcher to add them to.
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	walk()
+
+	// A write names one file, so d/b.txt beneath d stays cached.
+	handleWatchEvent(logger, w, root, opts.Cache, fsnotify.Event{Name: filepath.Join(root, "d"), Op: fsnotify.Write})
+	if n := walk(); n != 0 {
+		t.Errorf("after a write to d: opened %d files, want none", n)
+	}
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Remove, fsnotify.Rename} {
+		handleWatchEvent(logger, w, root, opts.Cache, fsnotify.Event{Name: filepath.Join(root, "d"), Op: op})
+		if n := walk(); n != 1 {
+			t.Errorf("after %s of d: opened %d files, want d/b.txt again", op, n)
+		}
+	}
+}